@@ -0,0 +1,131 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the normalisation of command arguments for the cache key.
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Normalize are the rules applied to arguments before they're part of the
+// cache key.
+type Normalize struct {
+	// IgnoreFlags are flags left out of the key, e.g. "-j" ignores -j8,
+	// -j 8 and -j=8.
+	IgnoreFlags []string `json:"ignoreFlags,omitempty"`
+
+	// RelativePaths rewrites absolute paths under the root relative to it,
+	// and those under the home directory relative to ~.
+	RelativePaths bool `json:"relativePaths,omitempty"`
+
+	// CanonicalBinary replaces the command with the name of the binary it
+	// resolves to, following symlinks, so cc and gcc share entries.
+	CanonicalBinary bool `json:"canonicalBinary,omitempty"`
+}
+
+// NormalizeArgs applies the rules to a command's arguments, rules is nil
+// if there are none.
+func NormalizeArgs(cmdArgs []string, rules *Normalize) []string {
+	if rules == nil || len(cmdArgs) == 0 {
+		return cmdArgs
+	}
+
+	normalized := make([]string, 0, len(cmdArgs))
+	command := cmdArgs[0]
+	if rules.CanonicalBinary {
+		command = canonicalBinary(command)
+	}
+	normalized = append(normalized, command)
+
+	for i := 1; i < len(cmdArgs); i++ {
+		arg := cmdArgs[i]
+		if flag, ok := ignoredFlag(arg, rules.IgnoreFlags); ok {
+			// A separate numeric value belongs to the flag.
+			if arg == flag && i+1 < len(cmdArgs) && isNumber(cmdArgs[i+1]) {
+				i++
+			}
+			continue
+		}
+
+		if rules.RelativePaths {
+			arg = relativeArg(arg)
+		}
+		normalized = append(normalized, arg)
+	}
+
+	return normalized
+}
+
+// ignoredFlag returns the ignored flag an argument is, if any.
+func ignoredFlag(arg string, flags []string) (string, bool) {
+	for _, flag := range flags {
+		if arg == flag || strings.HasPrefix(arg, flag+"=") {
+			return flag, true
+		}
+
+		// Short flags can have their value joined, like -j8.
+		if len(flag) == 2 && flag[0] == '-' && strings.HasPrefix(arg, flag) && isNumber(arg[2:]) {
+			return flag, true
+		}
+	}
+
+	return "", false
+}
+
+// isNumber checks if a string is all digits.
+func isNumber(value string) bool {
+	if value == "" {
+		return false
+	}
+
+	for _, r := range value {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// relativeArg rewrites an absolute path, or the value of a --flag=path,
+// relative to the root or home directory.
+func relativeArg(arg string) string {
+	if i := strings.Index(arg, "="); i > 0 && strings.HasPrefix(arg, "-") {
+		return arg[:i+1] + relativePath(arg[i+1:])
+	}
+
+	return relativePath(arg)
+}
+
+// relativePath rewrites an absolute path under the root relative to it,
+// and under the home directory relative to ~.
+func relativePath(path string) string {
+	if !filepath.IsAbs(path) {
+		return path
+	}
+
+	if rel, err := filepath.Rel(root, path); root != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		return filepath.ToSlash(rel)
+	}
+	home := os.Getenv(homeVar)
+	if rel, err := filepath.Rel(home, path); home != "" && err == nil && !strings.HasPrefix(rel, "..") {
+		return "~/" + filepath.ToSlash(rel)
+	}
+
+	return path
+}
+
+// canonicalBinary returns the name of the binary a command resolves to,
+// the command itself if it can't be found.
+func canonicalBinary(command string) string {
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return command
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	return filepath.Base(path)
+}
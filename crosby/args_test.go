@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeArgs(t *testing.T) {
+	oldRoot, oldHome := root, homeVar
+	root, homeVar = "/src/app", "CROSBY_TEST_HOME"
+	defer func() { root, homeVar = oldRoot, oldHome }()
+	os.Setenv("CROSBY_TEST_HOME", "/home/dev")
+	defer os.Unsetenv("CROSBY_TEST_HOME")
+
+	rules := &Normalize{IgnoreFlags: []string{"-j", "--jobs"}, RelativePaths: true}
+	cases := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"make", "-j8"}, []string{"make"}},
+		{[]string{"make", "-j", "4", "all"}, []string{"make", "all"}},
+		{[]string{"make", "--jobs=4", "-jx"}, []string{"make", "-jx"}},
+		{[]string{"cc", "/src/app/lib/a.c", "-o", "/home/dev/bin/a"}, []string{"cc", "lib/a.c", "-o", "~/bin/a"}},
+		{[]string{"cc", "--out=/src/app/a", "/usr/include"}, []string{"cc", "--out=a", "/usr/include"}},
+	}
+
+	for _, c := range cases {
+		if normalized := NormalizeArgs(c.args, rules); !reflect.DeepEqual(normalized, c.expected) {
+			t.Error(c.args, "expected", c.expected, "got", normalized)
+		}
+	}
+
+	args := []string{"make", "-j8"}
+	if normalized := NormalizeArgs(args, nil); !reflect.DeepEqual(normalized, args) {
+		t.Error("expected args to be unchanged without rules, got", normalized)
+	}
+}
+
+func TestCanonicalBinaryKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bin := filepath.Join(dir, "bin")
+	os.MkdirAll(bin, 0755)
+	ioutil.WriteFile(filepath.Join(bin, "gcc"), []byte("#!/bin/sh\n"), 0755)
+	if err := os.Symlink("gcc", filepath.Join(bin, "cc")); err != nil {
+		t.Skip("symlinks aren't supported:", err)
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", bin)
+	defer os.Setenv("PATH", oldPath)
+	oldRoot, oldConfig, oldArgs := root, config, args
+	root = dir
+	config = &Config{NoGit: true, Normalize: &Normalize{CanonicalBinary: true}}
+	defer func() { root, config, args = oldRoot, oldConfig, oldArgs }()
+
+	keys := []string{}
+	for _, command := range []string{"cc", "gcc"} {
+		args = []string{command, "x.c"}
+		s, err := Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := s.Toolchain["gcc"]; !ok || len(s.Toolchain) != 1 {
+			t.Error("expected", command, "to be keyed as gcc, got", s.Toolchain)
+		}
+		keys = append(keys, s.Key)
+	}
+	if keys[0] != keys[1] {
+		t.Error("expected cc and gcc to share a key, got", keys)
+	}
+}
@@ -0,0 +1,385 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the backend for remote caches speaking the Bazel HTTP
+// protocol, so one cache server can be shared with Bazel.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Path of the entry in the action results crosby stores.
+const bazelEntryPath = "crosby/entry"
+
+// ErrBazelNotFound is returned when the cache doesn't have an object.
+var ErrBazelNotFound = errors.New("not found in the remote cache")
+
+// BazelCache stores entries and blobs in a Bazel HTTP remote cache. An
+// entry is an action result keyed by the entry's key digest, with a single
+// output holding the entry. Blobs are CAS objects, the entry lists the
+// digest of each so they're read directly. Objects can't be removed, the
+// server evicts them.
+type BazelCache struct {
+	URL    string
+	Client *http.Client
+
+	// digests are the CAS objects of the blobs written or listed by the
+	// entries found.
+	mutex   sync.Mutex
+	digests map[primitive.ObjectID]*bazelDigest
+}
+
+// bazelEntry is an entry with the digests of its blobs.
+type bazelEntry struct {
+	*Source
+	Blobs map[string]*bazelDigest `json:"blobs"`
+}
+
+// NewBazelCache creates a client for the cache at url.
+func NewBazelCache(url string) *BazelCache {
+	timeout := ConnectTimeout()
+
+	return &BazelCache{
+		URL:     strings.TrimSuffix(url, "/"),
+		digests: map[primitive.ObjectID]*bazelDigest{},
+		Client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			Dial:                  (&net.Dialer{Timeout: timeout}).Dial,
+			ResponseHeaderTimeout: timeout * 6,
+		}},
+	}
+}
+
+// get reads an object, the caller closes the body.
+func (bc *BazelCache) get(kind, hash string) (io.ReadCloser, error) {
+	res, err := bc.Client.Get(bc.URL + "/" + kind + "/" + hash)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, ErrBazelNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.New("remote cache responded with " + res.Status)
+	}
+
+	return res.Body, nil
+}
+
+// put writes an object of the given size.
+func (bc *BazelCache) put(kind, hash string, body io.Reader, size int64) error {
+	req, err := http.NewRequest("PUT", bc.URL+"/"+kind+"/"+hash, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	res, err := bc.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return errors.New("remote cache responded with " + res.Status)
+	}
+
+	return nil
+}
+
+// getAction reads an action result and returns the digest of an output.
+func (bc *BazelCache) getAction(hash, path string) (*bazelDigest, error) {
+	body, err := bc.get("ac", hash)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	outputs, err := decodeActionResult(data)
+	if err != nil {
+		return nil, err
+	}
+
+	digest, ok := outputs[path]
+	if !ok {
+		return nil, errors.New("action result " + hash + " has no " + path)
+	}
+	return digest, nil
+}
+
+// putAction writes an action result with a single output.
+func (bc *BazelCache) putAction(hash, path string, digest *bazelDigest) error {
+	data := encodeActionResult(path, digest)
+	return bc.put("ac", hash, bytes.NewReader(data), int64(len(data)))
+}
+
+// Find reads the entry stored under the source's key digest.
+func (bc *BazelCache) Find(s *Source) ([]Source, error) {
+	digest, err := bc.getAction(s.KeyDigest(), bazelEntryPath)
+	if err == ErrBazelNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := bc.get("cas", digest.Hash)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(data)) != digest.Hash {
+		return nil, errors.New("remote cache entry " + digest.Hash + " is corrupt")
+	}
+
+	entry := bazelEntry{Source: &Source{}}
+	if err = json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	bc.mutex.Lock()
+	for hex, blob := range entry.Blobs {
+		if id, err := primitive.ObjectIDFromHex(hex); err == nil {
+			bc.digests[id] = blob
+		}
+	}
+	bc.mutex.Unlock()
+	return []Source{*entry.Source}, nil
+}
+
+// Insert stores an entry with the digests of its blobs as a CAS object,
+// and points its key digest at it.
+func (bc *BazelCache) Insert(s *Source) error {
+	entry := bazelEntry{Source: s, Blobs: map[string]*bazelDigest{}}
+	bc.mutex.Lock()
+	for _, id := range s.ResultIds {
+		entry.Blobs[id.Hex()] = bc.digests[id]
+	}
+	bc.mutex.Unlock()
+	for hex, blob := range entry.Blobs {
+		if blob == nil {
+			return errors.New("Blob " + hex + " wasn't uploaded to the remote cache.")
+		}
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	digest := &bazelDigest{fmt.Sprintf("%x", sha256.Sum256(data)), int64(len(data))}
+	if err = bc.put("cas", digest.Hash, bytes.NewReader(data), digest.Size); err != nil {
+		return err
+	}
+	return bc.putAction(s.KeyDigest(), bazelEntryPath, digest)
+}
+
+// RecordHit fails, action results can't be updated.
+func (bc *BazelCache) RecordHit(s *Source, saved time.Duration) error {
+	return ErrUnsupported
+}
+
+// Delete fails, action results can't be removed.
+func (bc *BazelCache) Delete(s *Source) error {
+	return ErrUnsupported
+}
+
+// Create starts a blob, it's uploaded as a CAS object when it's closed
+// and its digest is kept for the entry.
+func (bc *BazelCache) Create(name string, meta bson.M) (Blob, error) {
+	return newTempBlob(func(id primitive.ObjectID, body io.Reader, size int64, sum string) error {
+		digest := &bazelDigest{sum, size}
+		if err := bc.put("cas", digest.Hash, body, size); err != nil {
+			return err
+		}
+
+		bc.mutex.Lock()
+		bc.digests[id] = digest
+		bc.mutex.Unlock()
+		return nil
+	})
+}
+
+// Open reads a blob by the digest listed in its entry, or written by
+// Create.
+func (bc *BazelCache) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	bc.mutex.Lock()
+	digest, ok := bc.digests[id]
+	bc.mutex.Unlock()
+	if !ok {
+		return nil, ErrBazelNotFound
+	}
+
+	return bc.get("cas", digest.Hash)
+}
+
+// Remove does nothing, the server evicts objects itself.
+func (bc *BazelCache) Remove(id primitive.ObjectID) error {
+	return nil
+}
+
+// bazelDigest is a Digest message, the sha256 and size of an object.
+type bazelDigest struct {
+	Hash string
+	Size int64
+}
+
+// Protobuf wire types used by the messages.
+const (
+	wireVarint = 0
+	wire64Bit  = 1
+	wireBytes  = 2
+	wire32Bit  = 5
+)
+
+// appendTag appends a field tag.
+func appendTag(buf []byte, field, wire int) []byte {
+	return appendVarint(buf, uint64(field<<3|wire))
+}
+
+// appendVarint appends a varint.
+func appendVarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	return append(buf, tmp[:binary.PutUvarint(tmp[:], v)]...)
+}
+
+// appendBytes appends a length delimited field.
+func appendBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendTag(buf, field, wireBytes)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+// encodeActionResult encodes an ActionResult with a single output file,
+// enough for servers that validate action results.
+func encodeActionResult(path string, digest *bazelDigest) []byte {
+	// Digest{hash = 1, size_bytes = 2}
+	d := appendBytes(nil, 1, []byte(digest.Hash))
+	d = appendTag(d, 2, wireVarint)
+	d = appendVarint(d, uint64(digest.Size))
+
+	// OutputFile{path = 1, digest = 2}
+	file := appendBytes(nil, 1, []byte(path))
+	file = appendBytes(file, 2, d)
+
+	// ActionResult{output_files = 2}
+	return appendBytes(nil, 2, file)
+}
+
+// protoField is a field read from a message, data is set for length
+// delimited fields and value for varints.
+type protoField struct {
+	num   int
+	data  []byte
+	value uint64
+}
+
+// decodeFields reads the fields of a message, skipping fixed size ones.
+func decodeFields(buf []byte) ([]protoField, error) {
+	fields := []protoField{}
+	for len(buf) > 0 {
+		tag, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errors.New("invalid protobuf tag")
+		}
+		buf = buf[n:]
+
+		field := protoField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case wireVarint:
+			field.value, n = binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errors.New("invalid protobuf varint")
+			}
+			buf = buf[n:]
+		case wireBytes:
+			size, n := binary.Uvarint(buf)
+			if n <= 0 || uint64(len(buf)-n) < size {
+				return nil, errors.New("invalid protobuf length")
+			}
+			field.data = buf[n : n+int(size)]
+			buf = buf[n+int(size):]
+		case wire64Bit, wire32Bit:
+			size := 8
+			if tag&7 == wire32Bit {
+				size = 4
+			}
+			if len(buf) < size {
+				return nil, errors.New("invalid protobuf fixed field")
+			}
+			buf = buf[size:]
+		default:
+			return nil, errors.New("unsupported protobuf wire type")
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+// decodeActionResult returns the digests of an ActionResult's output
+// files by path.
+func decodeActionResult(data []byte) (map[string]*bazelDigest, error) {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := map[string]*bazelDigest{}
+	for _, field := range fields {
+		if field.num != 2 {
+			continue
+		}
+		fileFields, err := decodeFields(field.data)
+		if err != nil {
+			return nil, err
+		}
+
+		var path string
+		digest := &bazelDigest{}
+		for _, ff := range fileFields {
+			switch ff.num {
+			case 1:
+				path = string(ff.data)
+			case 2:
+				digestFields, err := decodeFields(ff.data)
+				if err != nil {
+					return nil, err
+				}
+				for _, df := range digestFields {
+					if df.num == 1 {
+						digest.Hash = string(df.data)
+					} else if df.num == 2 {
+						digest.Size = int64(df.value)
+					}
+				}
+			}
+		}
+		outputs[path] = digest
+	}
+
+	return outputs, nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// bazelServer is a stand-in for a Bazel HTTP remote cache, it keeps
+// objects in memory and rejects action results that don't decode.
+type bazelServer struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+func (bs *bazelServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if !strings.HasPrefix(req.URL.Path, "/ac/") && !strings.HasPrefix(req.URL.Path, "/cas/") {
+		http.NotFound(res, req)
+		return
+	}
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	switch req.Method {
+	case "GET":
+		data, ok := bs.objects[req.URL.Path]
+		if !ok {
+			http.NotFound(res, req)
+			return
+		}
+		res.Write(data)
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.HasPrefix(req.URL.Path, "/ac/") {
+			if _, err := decodeActionResult(data); err != nil {
+				http.Error(res, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		bs.objects[req.URL.Path] = data
+	default:
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestActionResult(t *testing.T) {
+	digest := &bazelDigest{strings.Repeat("ab", 32), 300}
+	outputs, err := decodeActionResult(encodeActionResult("crosby/entry", digest))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := outputs["crosby/entry"]; got == nil || *got != *digest {
+		t.Error("unexpected outputs", outputs)
+	}
+}
+
+func TestBazelCache(t *testing.T) {
+	server := &bazelServer{objects: map[string][]byte{}}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	old := config
+	config = &Config{}
+	defer func() { config = old }()
+	bc := NewBazelCache(ts.URL + "/")
+
+	ids := []primitive.ObjectID{}
+	for _, contents := range []string{"contents", "pack", "part"} {
+		blob, err := bc.Create("out", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob.Write([]byte(contents))
+		if err = blob.Close(); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, blob.Id())
+	}
+
+	body, err := bc.Open(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "contents" {
+		t.Error("unexpected blob contents", string(data))
+	}
+
+	s := &Source{
+		Id:        primitive.NewObjectID(),
+		Namespace: "test",
+		Args:      []string{"make"},
+		Files:     map[string]string{"main_c": "a"},
+		ResultIds: ids,
+		Outputs: []Output{
+			{Id: ids[0], Path: "main", Digest: "b", Size: 8},
+			{Pack: ids[1], Path: "main.o", Digest: "c", Size: 4},
+			{Path: "big", Parts: []Part{{Id: ids[2], Size: 4}}},
+		},
+		Packs: []Pack{{Id: ids[1], Codec: CodecGzip, Count: 1}},
+	}
+	if err = bc.Insert(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Another client reads blobs by the digests in the entry, the only
+	// action result is the entry's.
+	other := NewBazelCache(ts.URL)
+	if _, err = other.Open(ids[0]); !IsNotFound(err) {
+		t.Error("expected an unknown blob not to be found, got", err)
+	}
+	results, err := other.Find(&Source{Namespace: "test", Args: []string{"make"}, Files: map[string]string{"main_c": "a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || !reflect.DeepEqual(&results[0], s) {
+		t.Error("expected the entry to round trip, got", results)
+	}
+	body, err = other.Open(ids[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "part" {
+		t.Error("unexpected blob contents", string(data))
+	}
+	actions := 0
+	for path := range server.objects {
+		if strings.HasPrefix(path, "/ac/") {
+			actions++
+		}
+	}
+	if actions != 1 {
+		t.Error("expected only the entry to be an action result, got", actions)
+	}
+
+	if err = other.Delete(s); err != ErrUnsupported {
+		t.Error("expected deleting an entry to be unsupported, got", err)
+	}
+	if err = other.RecordHit(s, 0); err != ErrUnsupported {
+		t.Error("expected recording a hit to be unsupported, got", err)
+	}
+
+	results, err = bc.Find(&Source{Namespace: "test", Args: []string{"make", "all"}})
+	if err != nil || len(results) != 0 {
+		t.Error("expected a miss, got", results, err)
+	}
+}
@@ -0,0 +1,266 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the local disk cache that sits in front of a remote store.
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Default size of the local cache, 5 GB.
+const defaultLocalCacheSize = 5 << 30
+
+// LocalCache keeps copies of blobs on disk. Blobs written go to both the
+// remote store and disk, blobs read come from disk when they're there.
+// Once the cache is over MaxSize the least recently used blobs are removed.
+type LocalCache struct {
+	Dir     string
+	MaxSize int64
+	Remote  Store
+	mutex   sync.Mutex
+
+	// size is the running total of the blobs kept, the directory is only
+	// read when it's unknown or goes over MaxSize.
+	size  int64
+	sized bool
+}
+
+// NewLocalCache creates a local cache in dir in front of remote.
+func NewLocalCache(dir string, maxSize int64, remote Store) (*LocalCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm|os.ModeDir); err != nil {
+		return nil, err
+	}
+	if maxSize <= 0 {
+		maxSize = defaultLocalCacheSize
+	}
+
+	return &LocalCache{Dir: dir, MaxSize: maxSize, Remote: remote}, nil
+}
+
+// path returns where a blob is kept on disk.
+func (lc *LocalCache) path(id primitive.ObjectID) string {
+	return filepath.Join(lc.Dir, id.Hex())
+}
+
+// Create writes a blob to the remote store and disk.
+func (lc *LocalCache) Create(name string, meta bson.M) (Blob, error) {
+	blob, err := lc.Remote.Create(name, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	temp, err := ioutil.TempFile(lc.Dir, "tmp-")
+	if err != nil {
+		return nil, abortFile(blob, err)
+	}
+
+	return &localBlob{Blob: blob, cache: lc, temp: temp}, nil
+}
+
+// Open reads a blob from disk, or from the remote store keeping a copy.
+func (lc *LocalCache) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	path := lc.path(id)
+	file, err := os.Open(path)
+	if err == nil {
+		now := time.Now()
+		os.Chtimes(path, now, now)
+		return file, nil
+	}
+
+	remote, err := lc.Remote.Open(id)
+	if err != nil {
+		return nil, err
+	}
+
+	temp, err := ioutil.TempFile(lc.Dir, "tmp-")
+	if err != nil {
+		// Can't keep a copy, so just read from the remote store.
+		return remote, nil
+	}
+
+	return &localReader{remote: remote, cache: lc, id: id, temp: temp}, nil
+}
+
+// Remove deletes a blob from disk and the remote store.
+func (lc *LocalCache) Remove(id primitive.ObjectID) error {
+	if info, err := os.Stat(lc.path(id)); err == nil && os.Remove(lc.path(id)) == nil {
+		lc.mutex.Lock()
+		lc.size -= info.Size()
+		lc.mutex.Unlock()
+	}
+	return lc.Remote.Remove(id)
+}
+
+// keep moves a fully written temp file into the cache, evicting old blobs
+// if it puts the cache over its size.
+func (lc *LocalCache) keep(temp *os.File, id primitive.ObjectID) {
+	info, err := temp.Stat()
+	temp.Close()
+	if err == nil {
+		err = os.Rename(temp.Name(), lc.path(id))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return
+	}
+
+	lc.mutex.Lock()
+	lc.size += info.Size()
+	over := !lc.sized || lc.size > lc.MaxSize
+	lc.mutex.Unlock()
+	if over {
+		lc.Evict()
+	}
+}
+
+// Evict removes the least recently used blobs until the cache fits in
+// MaxSize.
+func (lc *LocalCache) Evict() error {
+	lc.mutex.Lock()
+	defer lc.mutex.Unlock()
+
+	infos, err := ioutil.ReadDir(lc.Dir)
+	if err != nil {
+		return err
+	}
+
+	var total int64
+	blobs := make([]os.FileInfo, 0, len(infos))
+	for _, info := range infos {
+		if primitive.IsValidObjectID(info.Name()) {
+			blobs = append(blobs, info)
+			total += info.Size()
+		}
+	}
+	sort.Sort(byModTime(blobs))
+
+	for _, info := range blobs {
+		if total <= lc.MaxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(lc.Dir, info.Name())); err == nil {
+			total -= info.Size()
+		}
+	}
+	lc.size, lc.sized = total, true
+
+	return nil
+}
+
+// byModTime sorts files oldest first.
+type byModTime []os.FileInfo
+
+func (b byModTime) Len() int           { return len(b) }
+func (b byModTime) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byModTime) Less(i, j int) bool { return b[i].ModTime().Before(b[j].ModTime()) }
+
+// localBlob writes to a remote blob and a temp file.
+type localBlob struct {
+	Blob
+	cache *LocalCache
+	temp  *os.File
+}
+
+// Write writes to both the remote blob and the temp file.
+func (lb *localBlob) Write(b []byte) (int, error) {
+	n, err := lb.Blob.Write(b)
+	if err != nil {
+		return n, err
+	}
+
+	if lb.temp != nil {
+		if _, err := lb.temp.Write(b); err != nil {
+			// Only the local copy failed, keep writing to the remote.
+			lb.discard()
+		}
+	}
+	return n, nil
+}
+
+// Abort discards the remote blob and the temp file.
+func (lb *localBlob) Abort() {
+	lb.discard()
+	lb.Blob.Abort()
+}
+
+// Close stores the remote blob and then keeps the local copy.
+func (lb *localBlob) Close() error {
+	if err := lb.Blob.Close(); err != nil {
+		lb.discard()
+		return err
+	}
+
+	if lb.temp != nil {
+		lb.cache.keep(lb.temp, lb.Blob.Id())
+	}
+	return nil
+}
+
+func (lb *localBlob) discard() {
+	if lb.temp != nil {
+		lb.temp.Close()
+		os.Remove(lb.temp.Name())
+		lb.temp = nil
+	}
+}
+
+// localReader reads a remote blob, copying it into a temp file that's
+// kept once the blob has been read fully.
+type localReader struct {
+	remote io.ReadCloser
+	cache  *LocalCache
+	id     primitive.ObjectID
+	temp   *os.File
+	done   bool
+}
+
+// Read reads from the remote blob, copying to the temp file.
+func (lr *localReader) Read(b []byte) (int, error) {
+	n, err := lr.remote.Read(b)
+	if n > 0 && lr.temp != nil {
+		if _, werr := lr.temp.Write(b[:n]); werr != nil {
+			lr.discard()
+		}
+	}
+	if err == io.EOF {
+		lr.done = true
+	}
+
+	return n, err
+}
+
+// Close closes the remote blob, keeping the copy if it's complete. Decoders
+// can stop short of EOF so the rest of the blob is read first.
+func (lr *localReader) Close() error {
+	if lr.temp != nil && !lr.done {
+		io.Copy(ioutil.Discard, lr)
+	}
+
+	err := lr.remote.Close()
+	if lr.temp == nil {
+		return err
+	}
+
+	if lr.done && err == nil {
+		lr.cache.keep(lr.temp, lr.id)
+		return nil
+	}
+	lr.discard()
+	return err
+}
+
+func (lr *localReader) discard() {
+	if lr.temp != nil {
+		lr.temp.Close()
+		os.Remove(lr.temp.Name())
+		lr.temp = nil
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryStore is a Store kept in memory.
+type memoryStore struct {
+	sync.Mutex
+	blobs  map[primitive.ObjectID][]byte
+	opens  int
+	closes int
+}
+
+type memoryBlob struct {
+	bytes.Buffer
+	id    primitive.ObjectID
+	store *memoryStore
+}
+
+func (mb *memoryBlob) Id() primitive.ObjectID { return mb.id }
+func (mb *memoryBlob) Abort()                 {}
+func (mb *memoryBlob) Close() error {
+	mb.store.Lock()
+	defer mb.store.Unlock()
+	mb.store.blobs[mb.id] = mb.Bytes()
+	return nil
+}
+
+func (ms *memoryStore) Create(name string, meta bson.M) (Blob, error) {
+	return &memoryBlob{id: primitive.NewObjectID(), store: ms}, nil
+}
+
+func (ms *memoryStore) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	ms.Lock()
+	defer ms.Unlock()
+	ms.opens++
+	data, ok := ms.blobs[id]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return &memoryReader{bytes.NewReader(data), ms}, nil
+}
+
+// memoryReader counts when blobs are closed.
+type memoryReader struct {
+	*bytes.Reader
+	store *memoryStore
+}
+
+func (mr *memoryReader) Close() error {
+	mr.store.closes++
+	return nil
+}
+
+func (ms *memoryStore) Remove(id primitive.ObjectID) error {
+	ms.Lock()
+	defer ms.Unlock()
+	delete(ms.blobs, id)
+	return nil
+}
+
+func TestLocalCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	remote := &memoryStore{blobs: map[primitive.ObjectID][]byte{}}
+	local, err := NewLocalCache(dir, 10, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blob, err := local.Create("a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Write([]byte("crosby"))
+	if err := blob.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := local.Open(blob.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+	if string(data) != "crosby" || remote.opens != 0 {
+		t.Error("expected blob to be read from disk, got", string(data), remote.opens)
+	}
+
+	// A second blob puts the cache over its size, evicting the first.
+	other, _ := local.Create("b", nil)
+	other.Write([]byte("bowery"))
+	other.Close()
+	if _, err := os.Stat(local.path(blob.Id())); !os.IsNotExist(err) {
+		t.Error("expected least recently used blob to be evicted")
+	}
+
+	file, err = local.Open(blob.Id())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadAll(file)
+	file.Close()
+	if string(data) != "crosby" || remote.opens != 1 {
+		t.Error("expected blob to be read from the remote, got", string(data), remote.opens)
+	}
+
+	// The directory is only read again once the running total is over.
+	ioutil.WriteFile(local.path(primitive.NewObjectID()), []byte("untracked"), 0644)
+	small, _ := local.Create("c", nil)
+	small.Write([]byte("!"))
+	small.Close()
+	if local.size != 7 {
+		t.Error("expected the size to be kept without reading the directory, got", local.size)
+	}
+	large, _ := local.Create("d", nil)
+	large.Write([]byte("crosby"))
+	large.Close()
+	if local.size > local.MaxSize {
+		t.Error("expected the cache to be evicted once it's over, got", local.size)
+	}
+}
@@ -0,0 +1,341 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the crosby subcommands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Max number of entries listed by ls.
+const listLimit = 50
+
+// Command is a crosby subcommand.
+type Command struct {
+	Name  string
+	Usage string
+	Short string
+	Run   func(args []string) error
+}
+
+// List of subcommands, a command that isn't one of these is run.
+var Commands = []*Command{
+	&Command{"run", "run [--mode <mode>] [--ttl <d>] [--dry-run] [--] <command> [args...]", "Run a command with the cache", RunCommand},
+	&Command{"ls", "ls [--all] [command]", "List cached entries for this project and platform", ListCommand},
+	&Command{"show", "show <id>", "Show the manifest and metadata of an entry", ShowCommand},
+	&Command{"rm", "rm <id>...", "Evict entries from the cache", RemoveCommand},
+	&Command{"stats", "stats", "Show the size of the cache", StatsCommand},
+	&Command{"invalidate", "invalidate [--command <c>] [--project <p>] [--key <prefix>]", "Evict entries for a command, project or key", InvalidateCommand},
+	&Command{"gc", "gc [--max-age <d>] [--max-size <MB>] [--keep <n>]", "Remove expired entries and orphaned files", GCCommand},
+	&Command{"status", "status", "List results waiting to be uploaded", func(args []string) error { return StatusCommand() }},
+	&Command{"upload", "upload", "Upload results waiting in the spool", UploadCommand},
+	&Command{"keys", "keys <command>", "Manage signing and trusted keys", KeysCommand},
+	&Command{"reindex", "reindex", "Add every entry to the key-value index", ReindexCommand},
+	&Command{"presign", "presign [--listen <addr>]", "Hand out presigned urls for the s3 backend", PresignCommand},
+	&Command{"login", "login", "Register this machine with Crosby", LoginCommand},
+}
+
+// FindCommand returns the subcommand for the args and the args to pass it.
+// Commands after -- or that aren't subcommands are run.
+func FindCommand(args []string) (*Command, []string) {
+	if len(args) > 0 {
+		if args[0] == "--" {
+			return Commands[0], args
+		}
+		if args[0] == "help" || args[0] == "--help" || args[0] == "-h" {
+			return &Command{Run: HelpCommand}, args[1:]
+		}
+
+		for _, cmd := range Commands {
+			if cmd.Name == args[0] {
+				return cmd, args[1:]
+			}
+		}
+	}
+
+	return Commands[0], args
+}
+
+// HelpCommand prints the usage of every subcommand.
+func HelpCommand(args []string) error {
+	fmt.Println("Usage: crosby <command> [args...]")
+	fmt.Println("       crosby [run] [--] <command to cache> [args...]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	for _, cmd := range Commands {
+		fmt.Printf("  %-50s %s\n", cmd.Usage, cmd.Short)
+	}
+
+	return nil
+}
+
+// entrySize returns the total size of an entries outputs.
+func entrySize(s *Source) int64 {
+	var size int64
+	for _, out := range s.Outputs {
+		size += out.Size
+	}
+
+	return size
+}
+
+// findEntry finds an entry by its hex id.
+func findEntry(mb *MongoBackend, id string) (*Source, error) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, errors.New("Invalid entry id " + id)
+	}
+
+	entry, err := mb.FindId(objectId)
+	if err != nil {
+		return nil, errors.New("Unable to find entry " + id + ": " + err.Error())
+	}
+	return entry, nil
+}
+
+// ListCommand lists the newest entries for this project and platform,
+// optionally only those for a command. With --all every project in the
+// namespace is listed.
+func ListCommand(args []string) error {
+	var all bool
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.BoolVar(&all, "all", false, "")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\nUsage: crosby ls [--all] [command]")
+	}
+	args = flags.Args()
+
+	if err := PinRoot(); err != nil {
+		return err
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("ls")
+	if err != nil {
+		return err
+	}
+
+	query := bson.M{"namespace": Namespace(), "arch": HostArch()}
+	if !all {
+		query["project"] = ProjectName()
+	}
+	if len(args) > 0 {
+		query["args"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(args[0])}
+	}
+
+	entries, err := mb.FindAll(query, options.Find().SetProjection(bson.M{"files": 0}).
+		SetSort(bson.M{"_id": -1}).SetLimit(listLimit))
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No cached entries.")
+		return nil
+	}
+
+	for _, entry := range entries {
+		fmt.Printf("%s  %-14s %6d files %8.1f MB %5d hits  %s\n", entry.Id.Hex(),
+			time.Since(entry.Id.Timestamp())/time.Minute*time.Minute, len(entry.Outputs),
+			float64(entrySize(&entry))/(1<<20), entry.Hits, entry.Command)
+	}
+	return nil
+}
+
+// ShowCommand prints the manifest and metadata of an entry.
+func ShowCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: crosby show <id>")
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("show")
+	if err != nil {
+		return err
+	}
+
+	entry, err := findEntry(mb, args[0])
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %s\n", "id", entry.Id.Hex())
+	fmt.Printf("%-10s %s\n", "created", entry.Id.Timestamp().Format(time.RFC1123))
+	fmt.Printf("%-10s %s\n", "key", entry.Key)
+	fmt.Printf("%-10s %s\n", "namespace", entry.Namespace)
+	if entry.Project != "" {
+		fmt.Printf("%-10s %s\n", "project", entry.Project)
+	}
+	if entry.TTL > 0 {
+		fmt.Printf("%-10s %s (expires %s)\n", "ttl", entry.TTL, entry.Expires().Format(time.RFC1123))
+	}
+	fmt.Printf("%-10s %s\n", "arch", entry.Arch)
+	fmt.Printf("%-10s %s\n", "command", entry.Command)
+	fmt.Printf("%-10s %q\n", "args", entry.Args)
+	fmt.Printf("%-10s %d (root digest %s)\n", "files", len(entry.Files), entry.RootDigest())
+	if entry.KeyId != "" {
+		fmt.Printf("%-10s %s\n", "signed by", entry.KeyId)
+	}
+	if entry.RunDuration > 0 {
+		fmt.Printf("%-10s %s\n", "run time", entry.RunDuration)
+	}
+	fmt.Printf("%-10s %d\n", "hits", entry.Hits)
+	if !entry.LastHit.IsZero() {
+		fmt.Printf("%-10s %s\n", "last hit", entry.LastHit.Format(time.RFC1123))
+		fmt.Printf("%-10s %s\n", "saved", entry.TimeSaved)
+	}
+	for _, key := range sortedKeys(entry.Platform) {
+		fmt.Printf("%-10s %s=%s\n", "platform", key, entry.Platform[key])
+	}
+	for _, key := range sortedKeys(entry.Env) {
+		fmt.Printf("%-10s %s=%s\n", "env", key, entry.Env[key])
+	}
+	for _, key := range sortedKeys(entry.Toolchain) {
+		fmt.Printf("%-10s %s %s\n", "toolchain", key, entry.Toolchain[key])
+	}
+
+	fmt.Printf("\n%d outputs, %.1f MB in %d packs:\n", len(entry.Outputs),
+		float64(entrySize(entry))/(1<<20), len(entry.Packs))
+	for _, out := range entry.Outputs {
+		storage := "blob " + out.Id.Hex()
+		if !out.Pack.IsZero() {
+			storage = "pack " + out.Pack.Hex()
+		} else if len(out.Parts) > 0 {
+			storage = fmt.Sprintf("%d parts", len(out.Parts))
+		}
+
+		codec := out.Codec
+		if codec == CodecRaw {
+			codec = "raw"
+		}
+		fmt.Printf("  %-12d %-5s %-30s %s\n", out.Size, codec, storage, out.Path)
+	}
+	return nil
+}
+
+// sortedKeys returns the keys of a map in order.
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// RemoveEntry deletes an entry and its blobs, blobs that are already gone
+// are skipped.
+func RemoveEntry(entry *Source) error {
+	for _, id := range entry.ResultIds {
+		if err := store.Remove(id); err != nil && !IsNotFound(err) {
+			return err
+		}
+	}
+
+	return index.Delete(entry)
+}
+
+// RemoveCommand evicts entries by id.
+func RemoveCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New("Usage: crosby rm <id>...")
+	}
+	if !CanWrite(mode) {
+		return ErrReadOnly
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("rm")
+	if err != nil {
+		return err
+	}
+
+	for _, id := range args {
+		entry, err := findEntry(mb, id)
+		if err != nil {
+			return err
+		}
+		if err = RemoveEntry(entry); err != nil {
+			return err
+		}
+		fmt.Println("Removed", id)
+	}
+	return nil
+}
+
+// StatsCommand prints the number and size of entries in the cache.
+func StatsCommand(args []string) error {
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("stats")
+	if err != nil {
+		return err
+	}
+
+	var entries, blobs, hits int
+	var size int64
+	var saved time.Duration
+	platforms := map[string]int{}
+	err = mb.Each(bson.M{"arch": 1, "results": 1, "outputs.size": 1, "hits": 1, "timeSaved": 1}, func(entry *Source) error {
+		entries++
+		blobs += len(entry.ResultIds)
+		size += entrySize(entry)
+		hits += entry.Hits
+		saved += entry.TimeSaved
+		platforms[entry.Arch]++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d entries, %d blobs, %.1f MB of outputs\n", entries, blobs, float64(size)/(1<<20))
+	fmt.Printf("%d hits, saving %s\n", hits, saved/time.Second*time.Second)
+	names := make([]string, 0, len(platforms))
+	for name := range platforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-16s %d entries\n", name, platforms[name])
+	}
+	return nil
+}
+
+// UploadCommand uploads spooled results, it's run in the background by
+// StartUploader. The store of each result is opened as it's uploaded.
+func UploadCommand(args []string) error {
+	DrainSpool()
+	return nil
+}
+
+// LoginCommand registers a developer for this machine using their git
+// name and email.
+func LoginCommand(args []string) error {
+	if _, err := exec.LookPath("git"); err != nil {
+		return errors.New("Crosby uses your git name and email to log in, please install git.")
+	}
+
+	dev, err := CreateDeveloper()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Logged in as", dev.Name, "<"+dev.Email+">")
+	return nil
+}
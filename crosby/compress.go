@@ -0,0 +1,100 @@
+// Copyright 2014 Bowery, Inc.
+// Contains routines to compress blobs stored in the cache.
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Codecs a blob can be stored with. Blobs from before compression have
+// no codec and are raw.
+const (
+	CodecRaw  = ""
+	CodecGzip = "gzip"
+)
+
+// Compression is only kept if the sample shrinks to this ratio or less.
+const compressRatio = 0.9
+
+// Size of the sample read to decide if a file is compressible.
+const compressSample = 64 << 10
+
+// Extensions of formats that are already compressed.
+var compressedExts = map[string]bool{
+	".gz": true, ".tgz": true, ".bz2": true, ".xz": true, ".zst": true,
+	".zip": true, ".jar": true, ".7z": true, ".png": true, ".jpg": true,
+	".jpeg": true, ".gif": true, ".webp": true, ".mp3": true, ".mp4": true,
+	".woff": true, ".woff2": true,
+}
+
+// ChooseCodec picks the codec to store a file with, files that don't
+// compress well are stored raw.
+func ChooseCodec(path string) (string, error) {
+	if compressedExts[strings.ToLower(filepath.Ext(path))] {
+		return CodecRaw, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return CodecRaw, err
+	}
+	defer file.Close()
+
+	sample := make([]byte, compressSample)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return CodecRaw, err
+	}
+	if n == 0 {
+		return CodecRaw, nil
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(sample[:n])
+	gz.Close()
+
+	if float64(buf.Len()) > float64(n)*compressRatio {
+		return CodecRaw, nil
+	}
+	return CodecGzip, nil
+}
+
+// nopWriteCloser wraps a writer with a no-op Close.
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// Compress returns a writer that encodes to w with codec. Closing it
+// flushes the encoder but doesn't close w.
+func Compress(w io.Writer, codec string) (io.WriteCloser, error) {
+	switch codec {
+	case CodecRaw:
+		return nopWriteCloser{w}, nil
+	case CodecGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	}
+
+	return nil, errors.New("unknown codec " + codec)
+}
+
+// Decompress returns a reader that decodes r with codec.
+func Decompress(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecRaw:
+		return ioutil.NopCloser(r), nil
+	case CodecGzip:
+		return gzip.NewReader(r)
+	}
+
+	return nil, errors.New("unknown codec " + codec)
+}
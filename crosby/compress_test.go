@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChooseCodec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	text := filepath.Join(dir, "out.js")
+	ioutil.WriteFile(text, bytes.Repeat([]byte("module.exports = {};\n"), 1000), 0644)
+	if codec, err := ChooseCodec(text); err != nil || codec != CodecGzip {
+		t.Error("expected text to be compressed, got", codec, err)
+	}
+
+	random := make([]byte, 4096)
+	rand.Read(random)
+	binary := filepath.Join(dir, "out.bin")
+	ioutil.WriteFile(binary, random, 0644)
+	if codec, err := ChooseCodec(binary); err != nil || codec != CodecRaw {
+		t.Error("expected random data to be raw, got", codec, err)
+	}
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("crosby"), 1000)
+
+	var buf bytes.Buffer
+	w, err := Compress(&buf, CodecGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(data)
+	w.Close()
+	if buf.Len() >= len(data) {
+		t.Error("expected compressed data to be smaller")
+	}
+
+	r, err := Decompress(&buf, CodecGzip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(out, data) {
+		t.Error("decompressed data doesn't match", err)
+	}
+}
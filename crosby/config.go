@@ -0,0 +1,215 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the team configuration shared between developers.
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Config holds settings that are shared by a team. It is read from
+// ~/.crosby.json, overlaid with the nearest .crosby.json in the current
+// directory or its parents.
+type Config struct {
+	// SigningKey is the path to the ed25519 private key used to sign new
+	// cache entries. Entries are left unsigned if it's empty.
+	SigningKey string `json:"signingKey,omitempty"`
+
+	// TrustedKeys are the public keys allowed to sign entries. If any are
+	// set, entries without a valid signature are never restored.
+	TrustedKeys []*TrustedKey `json:"trustedKeys,omitempty"`
+
+	// Backend is where entries and blobs are stored, mongo, bazel or s3.
+	Backend string `json:"backend,omitempty"`
+
+	// Mongo is how to connect for the mongo backend.
+	Mongo *MongoConfig `json:"mongo,omitempty"`
+
+	// BazelURL is the url of the remote cache for the bazel backend, like
+	// http://cache:8080.
+	BazelURL string `json:"bazelURL,omitempty"`
+
+	// S3 is the bucket for the s3 backend.
+	S3 *S3Config `json:"s3,omitempty"`
+
+	// Index is a key-value store entries are indexed in, so lookups take
+	// a single round trip.
+	Index *IndexConfig `json:"index,omitempty"`
+
+	// Parallelism is the number of blobs restored at once. It can be
+	// overridden with CROSBY_PARALLELISM.
+	Parallelism int `json:"parallelism,omitempty"`
+
+	// LocalCache is the directory blobs are cached in on this machine,
+	// defaulting to ~/.crosby/cache. Set it to "off" to disable it.
+	LocalCache string `json:"localCache,omitempty"`
+
+	// LocalCacheSize is the size in MB the local cache is kept under.
+	LocalCacheSize int64 `json:"localCacheSize,omitempty"`
+
+	// Offline is what to do when the cache or API can't be reached, one of
+	// fail, warn or silent. It can be overridden with CROSBY_OFFLINE.
+	Offline string `json:"offline,omitempty"`
+
+	// ConnectTimeout is the number of seconds to wait when connecting.
+	ConnectTimeout int `json:"connectTimeout,omitempty"`
+
+	// BackgroundUpload spools results and uploads them from a background
+	// process. It can be overridden with CROSBY_BACKGROUND.
+	BackgroundUpload bool `json:"backgroundUpload,omitempty"`
+
+	// Mode limits reading or writing the cache, one of read-write,
+	// read-only, write-only or disabled. It can be overridden with
+	// CROSBY_MODE or --mode.
+	Mode string `json:"mode,omitempty"`
+
+	// Env are the env vars that are part of the cache key.
+	Env []string `json:"env,omitempty"`
+
+	// Platform are the components of the host platform in the cache key,
+	// any of os, arch, kernel, libc, cpu and distro. It defaults to os,
+	// arch and libc.
+	Platform []string `json:"platform,omitempty"`
+
+	// Normalize are the rules applied to the command's arguments before
+	// they're part of the cache key.
+	Normalize *Normalize `json:"normalize,omitempty"`
+
+	// Toolchain are the tools whose binaries are part of the cache key,
+	// the command itself is always included.
+	Toolchain []string `json:"toolchain,omitempty"`
+
+	// Root is the directory the cache is keyed from, commands are run and
+	// outputs restored there. It's "git" for the git toplevel, or a path
+	// relative to this file. It defaults to the current directory.
+	Root string `json:"root,omitempty"`
+
+	// Inputs are the subtrees of Root that are part of the cache key,
+	// every file under Root is if it's empty.
+	Inputs []string `json:"inputs,omitempty"`
+
+	// NoGit hashes every file instead of using the blob ids from git. It
+	// can also be turned off with CROSBY_GIT=0.
+	NoGit bool `json:"noGit,omitempty"`
+
+	// RewritePaths are patterns of text outputs, like "*.d", that have the
+	// root replaced with a placeholder when they're cached, and replaced
+	// with the local root when they're restored.
+	RewritePaths []string `json:"rewritePaths,omitempty"`
+
+	// Namespace scopes entries to a team or product, it's inferred from
+	// the git remote if it's empty. It can be overridden with
+	// CROSBY_NAMESPACE.
+	Namespace string `json:"namespace,omitempty"`
+
+	// SharedNamespace is read from when there's no result in Namespace,
+	// results are never written to it.
+	SharedNamespace string `json:"sharedNamespace,omitempty"`
+
+	// Project is the name entries are stored under for crosby invalidate,
+	// defaulting to the name of the current directory.
+	Project string `json:"project,omitempty"`
+
+	// TTL are how long entries for commands can be used before they're
+	// run again. The first rule matching the command is used.
+	TTL []*TTLRule `json:"ttl,omitempty"`
+
+	// Retention is the policy used by crosby gc.
+	Retention *Retention `json:"retention,omitempty"`
+}
+
+// TrustedKey is a named ed25519 public key, base64 encoded.
+type TrustedKey struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// ConfigPath returns the path of the config file in use.
+func ConfigPath() string {
+	for dir := root; ; dir = filepath.Dir(dir) {
+		project := filepath.Join(dir, ".crosby.json")
+		if _, err := os.Stat(project); err == nil {
+			return project
+		}
+		if dir == filepath.Dir(dir) {
+			break
+		}
+	}
+
+	return filepath.Join(os.Getenv(homeVar), ".crosby.json")
+}
+
+// LoadConfig reads ~/.crosby.json and overlays the project config on it,
+// a missing file is an empty config. Keys trusted in either file are
+// trusted, so a project can't turn off signature checks.
+func LoadConfig() (*Config, error) {
+	return LoadConfigAt(ConfigPath())
+}
+
+// LoadConfigAt reads ~/.crosby.json and overlays the config at path on it.
+func LoadConfigAt(path string) (*Config, error) {
+	homePath := filepath.Join(os.Getenv(homeVar), ".crosby.json")
+	cfg, err := ReadConfig(homePath)
+	if err != nil {
+		return nil, err
+	}
+	if path == homePath {
+		return cfg, nil
+	}
+
+	trusted := cfg.TrustedKeys
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	cfg.TrustedKeys = mergeKeys(trusted, cfg.TrustedKeys)
+
+	return cfg, nil
+}
+
+// ReadConfig reads a single config file, a missing file is an empty
+// config.
+func ReadConfig(path string) (*Config, error) {
+	cfg := &Config{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, json.Unmarshal(data, cfg)
+}
+
+// mergeKeys returns the keys in a followed by those in b that aren't in a.
+func mergeKeys(a, b []*TrustedKey) []*TrustedKey {
+	keys := append([]*TrustedKey{}, a...)
+	for _, key := range b {
+		found := false
+		for _, existing := range a {
+			found = found || existing.Key == key.Key
+		}
+		if !found {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// Save writes the config to the project config, or ~/.crosby.json if
+// there isn't one.
+func (cfg *Config) Save() error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(ConfigPath(), append(data, '\n'), 0644)
+}
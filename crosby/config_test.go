@@ -0,0 +1,49 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigOverlay(t *testing.T) {
+	home, err := ioutil.TempDir("", "crosby-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	project := filepath.Join(home, "src", "app")
+	os.MkdirAll(project, 0755)
+
+	oldRoot, oldHome := root, homeVar
+	root, homeVar = project, "CROSBY_TEST_HOME"
+	defer func() { root, homeVar = oldRoot, oldHome }()
+	os.Setenv("CROSBY_TEST_HOME", home)
+	defer os.Unsetenv("CROSBY_TEST_HOME")
+
+	ioutil.WriteFile(filepath.Join(home, ".crosby.json"),
+		[]byte(`{"signingKey": "/keys/dev", "trustedKeys": [{"name": "dev", "key": "a"}], "mode": "read-only"}`), 0644)
+	ioutil.WriteFile(filepath.Join(project, ".crosby.json"),
+		[]byte(`{"trustedKeys": [], "mode": "write-only", "project": "app"}`), 0644)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Mode != "write-only" || cfg.Project != "app" {
+		t.Error("expected the project config to override the home config, got", cfg.Mode, cfg.Project)
+	}
+	if cfg.SigningKey != "/keys/dev" {
+		t.Error("expected the signing key from the home config, got", cfg.SigningKey)
+	}
+	if len(cfg.TrustedKeys) != 1 || cfg.TrustedKeys[0].Name != "dev" {
+		t.Error("expected the project config not to drop trusted keys, got", cfg.TrustedKeys)
+	}
+
+	ioutil.WriteFile(filepath.Join(project, ".crosby.json"),
+		[]byte(`{"trustedKeys": [{"name": "ci", "key": "b"}, {"name": "dev", "key": "a"}]}`), 0644)
+	if cfg, err = LoadConfig(); err != nil || len(cfg.TrustedKeys) != 2 {
+		t.Error("expected keys from both configs to be trusted, got", cfg.TrustedKeys, err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright 2014 Bowery, Inc.
+// Contains how background processes are detached on unix.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach runs a command in its own session, so it doesn't get the signals
+// sent to the terminal when it's closed or interrupted.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
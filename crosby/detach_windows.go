@@ -0,0 +1,20 @@
+// Copyright 2014 Bowery, Inc.
+// Contains how background processes are detached on windows.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detach runs a command in a new process group, so it doesn't get the
+// Ctrl-C sent to the console.
+func detach(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP,
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the miss diagnosis, which compares a key with the closest
+// cached entry.
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Nearest finds the cached entry for the same command and platform in the
+// namespace with the most input files in common, nil if there are none.
+// Every entry for the command is ranked, reading only the keys of each.
+func Nearest(s *Source) (*Source, error) {
+	mb, err := requireMongo("--explain")
+	if err != nil {
+		return nil, err
+	}
+
+	var nearest *Source
+	best := -1
+	err = mb.EachMatching(bson.M{"namespace": s.Namespace, "argv": s.Args, "arch": s.Arch},
+		bson.M{"files": 1}, func(entry *Source) error {
+			matches := 0
+			for key, digest := range entry.Files {
+				if s.Files[key] == digest {
+					matches++
+				}
+			}
+
+			if matches > best {
+				nearest, best = entry, matches
+			}
+			return nil
+		})
+	if err != nil || nearest == nil {
+		return nil, err
+	}
+
+	return mb.FindId(nearest.Id)
+}
+
+// DiffSources lists the differences in the keys of two sources, by the
+// original names of the keys in want where they're known.
+func DiffSources(want, have *Source) []string {
+	diffs := diffKeys("file", want.Files, have.Files, want.names)
+	diffs = append(diffs, diffKeys("platform", want.Platform, have.Platform, nil)...)
+	diffs = append(diffs, diffKeys("env", want.Env, have.Env, want.names)...)
+	return append(diffs, diffKeys("toolchain", want.Toolchain, have.Toolchain, want.names)...)
+}
+
+// diffKeys lists the keys that were added, removed or changed.
+func diffKeys(name string, want, have, names map[string]string) []string {
+	display := func(key string) string {
+		if original, ok := names[key]; ok {
+			return original
+		}
+		return key
+	}
+
+	diffs := []string{}
+	for key, value := range want {
+		old, ok := have[key]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("+ %s %s (not in cached entry)", name, display(key)))
+		} else if old != value {
+			diffs = append(diffs, fmt.Sprintf("~ %s %s (%s, cached %s)", name, display(key), value, old))
+		}
+	}
+
+	for key := range have {
+		if _, ok := want[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("- %s %s (only in cached entry)", name, display(key)))
+		}
+	}
+
+	sort.Strings(diffs)
+	return diffs
+}
+
+// Diagnose explains a miss by printing how the key differs from the
+// closest cached entry.
+func Diagnose(s *Source) {
+	nearest, err := Nearest(s)
+	if err != nil {
+		fmt.Println("Unable to find cached entries to compare with:", err)
+		return
+	}
+	if nearest == nil {
+		fmt.Println("Nothing is cached for this command on", s.Arch, "in", s.Namespace+".")
+		return
+	}
+
+	diffs := DiffSources(s, nearest)
+	fmt.Printf("Closest cached entry is %s, %d differences:\n", nearest.Id.Hex(), len(diffs))
+	for _, diff := range diffs {
+		fmt.Println("  " + diff)
+	}
+}
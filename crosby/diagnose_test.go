@@ -0,0 +1,30 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiffSources(t *testing.T) {
+	want := &Source{
+		Files:     map[string]string{"main_c": "a", "util_c": "b", "new_c": "c"},
+		Env:       map[string]string{"CC": "clang"},
+		Toolchain: map[string]string{"make": "1"},
+		names:     map[string]string{"main_c": "main.c", "util_c": "util.c", "new_c": "new.c", "CC": "CC"},
+	}
+	have := &Source{
+		Files:     map[string]string{"main_c": "a", "util_c": "x", "old_c": "d"},
+		Env:       map[string]string{"CC": "gcc"},
+		Toolchain: map[string]string{"make": "1"},
+	}
+
+	expected := []string{
+		"+ file new.c (not in cached entry)",
+		"- file old_c (only in cached entry)",
+		"~ file util.c (b, cached x)",
+		"~ env CC (clang, cached gcc)",
+	}
+	if diffs := DiffSources(want, have); !reflect.DeepEqual(diffs, expected) {
+		t.Error("unexpected diff", diffs)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the dry run, which explains the cache key of a command.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// explain is set by --dry-run or --explain.
+var explain bool
+
+// Explain prints the components of the cache key and whether it's a hit,
+// result is nil on a miss.
+func Explain(s *Source, result *Source) {
+	fmt.Println("Cache key for", strings.Join(args, " "))
+	fmt.Printf("  %-10s %s\n", "key", s.Key)
+	fmt.Printf("  %-10s %s\n", "namespace", s.Namespace)
+	fmt.Printf("  %-10s %s\n", "root", root)
+	if s.Dir != "" {
+		fmt.Printf("  %-10s %s\n", "dir", s.Dir)
+	}
+	fmt.Printf("  %-10s %s\n", "arch", s.Arch)
+	fmt.Printf("  %-10s %q\n", "args", s.Args)
+	printKeys("platform", s.Platform)
+	printKeys("env", s.Env)
+	printKeys("toolchain", s.Toolchain)
+	fmt.Printf("  %-10s %d (root digest %s)\n", "files", len(s.Files), s.RootDigest())
+	if s.TTL > 0 {
+		fmt.Printf("  %-10s %s\n", "ttl", s.TTL)
+	}
+
+	if result == nil {
+		fmt.Println("Result: miss, the command would be run and cached.")
+		Diagnose(s)
+		return
+	}
+
+	var size int64
+	for _, out := range result.Outputs {
+		size += out.Size
+	}
+	age := time.Since(result.Id.Timestamp()) / time.Second * time.Second
+	fmt.Printf("Result: hit %s, %d files (%.1f MB) cached %s ago.\n",
+		result.Id.Hex(), len(result.Outputs), float64(size)/(1<<20), age)
+}
+
+// printKeys prints a key component sorted by name.
+func printKeys(name string, values map[string]string) {
+	if len(values) == 0 {
+		fmt.Printf("  %-10s (none)\n", name)
+		return
+	}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Printf("  %-10s %s=%s\n", name, key, values[key])
+		name = ""
+	}
+}
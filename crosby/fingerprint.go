@@ -0,0 +1,265 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the routines that compute the cache key for a command and look
+// it up.
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// keyName makes a name safe to use as a Mongo key.
+func keyName(name string) string {
+	return strings.Replace(name, ".", "_", -1)
+}
+
+// keyName makes a name safe to use as a Mongo key, remembering the
+// original so differences in the key can show it.
+func (s *Source) keyName(name string) string {
+	key := keyName(name)
+	if s.names == nil {
+		s.names = map[string]string{}
+	}
+	s.names[key] = name
+	return key
+}
+
+// Fingerprint computes the key of the command from the input files under
+// root, the env vars and tools listed in the config, and the command
+// binary.
+func Fingerprint() (*Source, error) {
+	s := &Source{
+		Namespace: Namespace(),
+		Dir:       RunDir(),
+		Arch:      HostArch(),
+		Command:   strings.Join(args, " "),
+		Args:      NormalizeArgs(args, config.Normalize),
+		Files:     map[string]string{},
+		Env:       map[string]string{},
+		Toolchain: map[string]string{},
+	}
+
+	platform, err := Platform()
+	if err != nil {
+		return nil, err
+	}
+	s.Platform = platform
+
+	for _, name := range config.Env {
+		s.Env[s.keyName(name)] = os.Getenv(name)
+	}
+
+	// The command is keyed by its normalised name, so aliases that
+	// canonicalBinary resolves to the same binary share entries.
+	tools := map[string]string{filepath.Base(s.Args[0]): args[0]}
+	for _, tool := range config.Toolchain {
+		tools[filepath.Base(tool)] = tool
+	}
+	for name, tool := range tools {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			// Not installed is part of the key too.
+			s.Toolchain[s.keyName(name)] = "missing"
+			continue
+		}
+
+		digest, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.Toolchain[s.keyName(name)] = digest
+	}
+
+	entryTTL, err := CommandTTL(s.Command)
+	if err != nil {
+		return nil, err
+	}
+	s.TTL = entryTTL
+	s.Project = ProjectName()
+
+	if UseGit() {
+		files, err := GitFiles()
+		var ignored []string
+		if err == nil {
+			ignored, err = GitIgnored()
+		}
+		if err == nil {
+			addGitFiles(s, files, ignored)
+			s.Key = s.KeyDigest()
+			return s, nil
+		}
+	}
+
+	err = filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
+		relPath, _ := filepath.Rel(root, path)
+		// ignore hidden directories and .
+		if relPath == "." || strings.Contains(relPath, ".git") {
+			return nil
+		}
+		if !isInput(relPath, config.Inputs) {
+			if err == nil && !f.IsDir() {
+				existing[relPath] = f.ModTime()
+			}
+			return nil
+		}
+
+		content, _ := ioutil.ReadFile(path)
+		s.Files[s.keyName(relPath)] = fmt.Sprintf("%x", md5.Sum(content))
+		return nil
+	})
+	s.Key = s.KeyDigest()
+
+	return s, err
+}
+
+// RootDigest returns a single digest covering every input file.
+func (s *Source) RootDigest() string {
+	keys := make([]string, 0, len(s.Files))
+	for key := range s.Files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s %s\n", key, s.Files[key])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// addGitFiles adds the input files found by GitFiles to a source, and
+// records the ignored files so unchanged ones aren't taken as outputs.
+func addGitFiles(s *Source, files map[string]string, ignored []string) {
+	for _, relPath := range ignored {
+		if info, err := os.Stat(filepath.Join(root, relPath)); err == nil {
+			existing[relPath] = info.ModTime()
+		}
+	}
+
+	for relPath, id := range files {
+		// Skip the same paths as a walk would.
+		if strings.Contains(relPath, ".git") {
+			continue
+		}
+		if !isInput(relPath, config.Inputs) {
+			if info, err := os.Stat(filepath.Join(root, relPath)); err == nil {
+				existing[relPath] = info.ModTime()
+			}
+			continue
+		}
+
+		s.Files[s.keyName(relPath)] = id
+	}
+}
+
+// KeyDigest returns a digest of the whole cache key, entries with the same
+// key have the same digest.
+func (s *Source) KeyDigest() string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "namespace %s\narch %s\nargs %q\nfiles %s\n", s.Namespace, s.Arch, s.Args, s.RootDigest())
+	if s.Dir != "" {
+		// Left out at the root so entries from before it was keyed match.
+		fmt.Fprintf(hash, "dir %s\n", s.Dir)
+	}
+	for _, key := range sortedKeys(s.Platform) {
+		fmt.Fprintf(hash, "platform %s %s\n", key, s.Platform[key])
+	}
+	for _, key := range sortedKeys(s.Env) {
+		fmt.Fprintf(hash, "env %s %s\n", key, s.Env[key])
+	}
+	for _, key := range sortedKeys(s.Toolchain) {
+		fmt.Fprintf(hash, "tool %s %s\n", key, s.Toolchain[key])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+// Query returns the Mongo query matching sources with the same key.
+func (s *Source) Query() bson.M {
+	query := bson.M{}
+	for key := range s.Files {
+		query["files."+key] = s.Files[key]
+	}
+	for key := range s.Platform {
+		query["platform."+key] = s.Platform[key]
+	}
+	for key := range s.Env {
+		query["env."+key] = s.Env[key]
+	}
+	for key := range s.Toolchain {
+		query["toolchain."+key] = s.Toolchain[key]
+	}
+	query["namespace"] = s.Namespace
+	query["arch"] = s.Arch
+	query["argv"] = s.Args
+	if s.Dir != "" {
+		query["dir"] = s.Dir
+	} else {
+		query["dir"] = bson.M{"$exists": false}
+	}
+
+	return query
+}
+
+// Matches checks if a source found by Query has no extra keys.
+func (s *Source) Matches(result *Source) bool {
+	return len(result.Files) == len(s.Files) && len(result.Env) == len(s.Env) &&
+		len(result.Platform) == len(s.Platform) &&
+		len(result.Toolchain) == len(s.Toolchain)
+}
+
+// Lookup finds the cached result for a source in its namespace, falling
+// back to the shared namespace. A nil source is returned if there's no
+// result.
+func Lookup(s *Source) (*Source, error) {
+	result, err := lookupIn(s, s.Namespace)
+	if err != nil || result != nil || config.SharedNamespace == "" ||
+		config.SharedNamespace == s.Namespace {
+		return result, err
+	}
+
+	return lookupIn(s, config.SharedNamespace)
+}
+
+// lookupIn finds the cached result for a source in a namespace, skipping
+// results that aren't trusted or have expired.
+func lookupIn(s *Source, namespace string) (*Source, error) {
+	key := *s
+	key.Namespace = namespace
+
+	results, err := index.Find(&key)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range results {
+		result := &results[i]
+		if !s.Matches(result) {
+			continue
+		}
+		if result.ExpiredFor(time.Now(), s.TTL) {
+			fmt.Println("Ignoring cached result "+result.Id.Hex()+", it expired",
+				time.Since(result.ExpiresFor(s.TTL))/time.Second*time.Second, "ago.")
+			continue
+		}
+
+		if len(config.TrustedKeys) > 0 {
+			if err := VerifySource(result, config.TrustedKeys); err != nil {
+				fmt.Println("Ignoring cached result "+result.Id.Hex()+":", err)
+				continue
+			}
+		}
+		return result, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,265 @@
+// Copyright 2014 Bowery, Inc.
+// Contains garbage collection of cache entries and orphaned blobs.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const gcUsage = `Usage: crosby gc [--max-age <duration>] [--max-idle <duration>] [--max-size <MB>]
+                [--keep <n>] [--dry-run] [--every <duration>]`
+
+// Blobs newer than this aren't orphans, they may be from an upload that
+// hasn't inserted its entry yet.
+const orphanGrace = 6 * time.Hour
+
+// Retention is the policy deciding which entries are kept. Zero values
+// disable a rule.
+type Retention struct {
+	// MaxAge removes entries created longer ago than this, e.g. "720h".
+	MaxAge string `json:"maxAge,omitempty"`
+
+	// MaxIdle removes entries that haven't been used for this long.
+	MaxIdle string `json:"maxIdle,omitempty"`
+
+	// MaxSize is the size in MB the cache is kept under, removing the least
+	// recently used entries first.
+	MaxSize int64 `json:"maxSize,omitempty"`
+
+	// KeepLatest is the number of entries kept for each command.
+	KeepLatest int `json:"keepLatest,omitempty"`
+}
+
+// lastUsed returns when an entry was last used, its last hit or when it
+// was created.
+func lastUsed(s *Source) time.Time {
+	if !s.LastHit.IsZero() {
+		return s.LastHit
+	}
+
+	return s.Id.Timestamp()
+}
+
+// parseDuration parses an optional duration.
+func parseDuration(d string) (time.Duration, error) {
+	if d == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(d)
+}
+
+// Expired returns the entries the policy removes.
+func (r *Retention) Expired(entries []Source, now time.Time) ([]Source, error) {
+	maxAge, err := parseDuration(r.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+	maxIdle, err := parseDuration(r.MaxIdle)
+	if err != nil {
+		return nil, err
+	}
+
+	// Newest first, so the latest for each command are seen first.
+	sorted := make([]Source, len(entries))
+	copy(sorted, entries)
+	sort.Sort(byCreated(sorted))
+
+	expired := []Source{}
+	kept := []Source{}
+	perCommand := map[string]int{}
+	for _, entry := range sorted {
+		// Older entries only have the command.
+		command := entry.Command
+		if len(entry.Args) > 0 {
+			command = fmt.Sprintf("%q", entry.Args)
+		}
+		command = entry.Namespace + " " + entry.Arch + " " + command
+		perCommand[command]++
+
+		switch {
+		case entry.Expired(now),
+			maxAge > 0 && now.Sub(entry.Id.Timestamp()) > maxAge,
+			maxIdle > 0 && now.Sub(lastUsed(&entry)) > maxIdle,
+			r.KeepLatest > 0 && perCommand[command] > r.KeepLatest:
+			expired = append(expired, entry)
+		default:
+			kept = append(kept, entry)
+		}
+	}
+
+	if r.MaxSize > 0 {
+		var total int64
+		for i := range kept {
+			total += entrySize(&kept[i])
+		}
+
+		sort.Sort(byLastUsed(kept))
+		for i := 0; i < len(kept) && total > r.MaxSize<<20; i++ {
+			total -= entrySize(&kept[i])
+			expired = append(expired, kept[i])
+		}
+	}
+
+	return expired, nil
+}
+
+// byCreated sorts entries newest first.
+type byCreated []Source
+
+func (b byCreated) Len() int           { return len(b) }
+func (b byCreated) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byCreated) Less(i, j int) bool { return b[i].Id.Timestamp().After(b[j].Id.Timestamp()) }
+
+// byLastUsed sorts entries least recently used first.
+type byLastUsed []Source
+
+func (b byLastUsed) Len() int           { return len(b) }
+func (b byLastUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastUsed) Less(i, j int) bool { return lastUsed(&b[i]).Before(lastUsed(&b[j])) }
+
+// CollectGarbage removes entries expired by the policy and blobs that no
+// entry refers to. With dryRun nothing is removed.
+func CollectGarbage(mb *MongoBackend, policy *Retention, dryRun bool) error {
+	entries, err := mb.FindAll(bson.M{}, options.Find().SetProjection(bson.M{"files": 0}))
+	if err != nil {
+		return err
+	}
+
+	expired, err := policy.Expired(entries, time.Now())
+	if err != nil {
+		return err
+	}
+
+	verb := "Removing"
+	if dryRun {
+		verb = "Would remove"
+	}
+
+	removed := map[primitive.ObjectID]bool{}
+	var freed int64
+	for i := range expired {
+		entry := &expired[i]
+		fmt.Printf("%s entry %s %s (%.1f MB)\n", verb, entry.Id.Hex(), entry.Command,
+			float64(entrySize(entry))/(1<<20))
+		removed[entry.Id] = true
+		freed += entrySize(entry)
+		if dryRun {
+			continue
+		}
+
+		if err := RemoveEntry(entry); err != nil {
+			return err
+		}
+	}
+
+	referenced := map[primitive.ObjectID]bool{}
+	for _, entry := range entries {
+		if removed[entry.Id] {
+			continue
+		}
+		for _, id := range entry.ResultIds {
+			referenced[id] = true
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoLongTimeout)
+	defer cancel()
+	cursor, err := mb.Files.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1, "length": 1, "uploadDate": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	orphans := 0
+	for cursor.Next(ctx) {
+		blob := struct {
+			Id         primitive.ObjectID `bson:"_id"`
+			Length     int64              `bson:"length"`
+			UploadDate time.Time          `bson:"uploadDate"`
+		}{}
+		if err := cursor.Decode(&blob); err != nil {
+			return err
+		}
+		if referenced[blob.Id] || time.Since(blob.UploadDate) < orphanGrace {
+			continue
+		}
+
+		orphans++
+		freed += blob.Length
+		if dryRun {
+			continue
+		}
+		if err := store.Remove(blob.Id); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s %d entries and %d orphaned blobs, freeing %.1f MB.\n",
+		verb, len(expired), orphans, float64(freed)/(1<<20))
+	return nil
+}
+
+// GCCommand collects garbage using the retention policy from the config,
+// overridden by flags. With --every it keeps running, collecting on an
+// interval.
+func GCCommand(args []string) error {
+	policy := config.Retention
+	if policy == nil {
+		policy = &Retention{}
+	}
+
+	var dryRun bool
+	var every time.Duration
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&policy.MaxAge, "max-age", policy.MaxAge, "")
+	flags.StringVar(&policy.MaxIdle, "max-idle", policy.MaxIdle, "")
+	flags.Int64Var(&policy.MaxSize, "max-size", policy.MaxSize, "")
+	flags.IntVar(&policy.KeepLatest, "keep", policy.KeepLatest, "")
+	flags.BoolVar(&dryRun, "dry-run", false, "")
+	flags.DurationVar(&every, "every", 0, "")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + gcUsage)
+	}
+
+	if !dryRun && !CanWrite(mode) {
+		return ErrReadOnly
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("gc")
+	if err != nil {
+		return err
+	}
+
+	for {
+		fmt.Println(time.Now().Format(time.RFC3339), "Collecting garbage")
+		if err := CollectGarbage(mb, policy, dryRun); err != nil {
+			if every == 0 {
+				return err
+			}
+			fmt.Println(err)
+		}
+
+		if every == 0 {
+			return nil
+		}
+		time.Sleep(every)
+	}
+}
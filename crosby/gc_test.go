@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRetentionExpired(t *testing.T) {
+	now := time.Now()
+	entry := func(args string, age time.Duration, size int64) Source {
+		return Source{
+			Id:      primitive.NewObjectIDFromTimestamp(now.Add(-age)),
+			Arch:    "linux-amd64",
+			Args:    strings.Fields(args),
+			Outputs: []Output{{Size: size << 20}},
+		}
+	}
+	entries := []Source{
+		entry("make", time.Hour, 10),
+		entry("make", 2*time.Hour, 10),
+		entry("make", 3*time.Hour, 10),
+		entry("npm install", 50*24*time.Hour, 10),
+		entry("npm install", 10*time.Hour, 30),
+	}
+
+	policy := &Retention{MaxAge: "720h", KeepLatest: 2, MaxSize: 40}
+	expired, err := policy.Expired(entries, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old npm install is too old, the third make is over the limit per
+	// command, and the newer npm install is removed to fit in 40 MB.
+	ids := map[primitive.ObjectID]bool{}
+	for _, e := range expired {
+		ids[e.Id] = true
+	}
+	if len(expired) != 3 || !ids[entries[2].Id] || !ids[entries[3].Id] || !ids[entries[4].Id] {
+		t.Error("unexpected entries expired", expired)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the fast fingerprinting of git checkouts, which reuses the blob
+// ids git already has for tracked files.
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// UseGit checks if git should be used to fingerprint files. It can be
+// turned off with noGit in the config or CROSBY_GIT=0.
+func UseGit() bool {
+	if os.Getenv("CROSBY_GIT") == "0" {
+		return false
+	}
+
+	return !config.NoGit
+}
+
+// git runs a git command in root and returns its output.
+func git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = root
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New("git " + args[0] + ": " + strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// splitNull splits null terminated output from git.
+func splitNull(out []byte) []string {
+	paths := strings.Split(string(out), "\x00")
+	if len(paths) > 0 && paths[len(paths)-1] == "" {
+		paths = paths[:len(paths)-1]
+	}
+
+	return paths
+}
+
+// parseLsFiles parses the output of git ls-files -s -z into blob ids by
+// path.
+func parseLsFiles(out []byte) (map[string]string, error) {
+	files := map[string]string{}
+	for _, line := range splitNull(out) {
+		// <mode> <object> <stage>\t<path>
+		tab := strings.Index(line, "\t")
+		if tab < 0 || len(strings.Fields(line[:tab])) != 3 {
+			return nil, errors.New("unexpected git ls-files output " + line)
+		}
+		fields := strings.Fields(line[:tab])
+
+		files[filepath.FromSlash(line[tab+1:])] = fields[1]
+	}
+
+	return files, nil
+}
+
+// gitBlobId returns the id git gives a file's contents, so untracked and
+// modified files are hashed the same as tracked ones.
+func gitBlobId(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha1.New()
+	fmt.Fprintf(hash, "blob %d\x00", info.Size())
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// GitFiles returns the blob ids of every file under root by path relative
+// to it. Tracked files use the ids from the index, only modified and
+// untracked files are read. An error is returned if root isn't in a git
+// repo.
+func GitFiles() (map[string]string, error) {
+	out, err := git("ls-files", "-s", "-z")
+	if err != nil {
+		return nil, err
+	}
+	files, err := parseLsFiles(out)
+	if err != nil {
+		return nil, err
+	}
+
+	// Modified includes deleted files. Ignored files like node_modules or
+	// build outputs aren't inputs, they're found by GitIgnored instead.
+	modified, err := git("ls-files", "-m", "-z")
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := git("ls-files", "-o", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, relPath := range append(splitNull(modified), splitNull(untracked)...) {
+		relPath = filepath.FromSlash(relPath)
+		id, err := gitBlobId(filepath.Join(root, relPath))
+		if os.IsNotExist(err) {
+			delete(files, relPath)
+			continue
+		}
+		if err != nil {
+			// Directories like nested repos are listed as untracked.
+			if info, statErr := os.Stat(filepath.Join(root, relPath)); statErr == nil && info.IsDir() {
+				continue
+			}
+			return nil, err
+		}
+		files[relPath] = id
+	}
+
+	return files, nil
+}
+
+// GitIgnored returns the paths of files under root that git ignores,
+// relative to it. They aren't hashed, but are recorded so they're only
+// cached as outputs if the command changes them.
+func GitIgnored() ([]string, error) {
+	out, err := git("ls-files", "-o", "-i", "--exclude-standard", "-z")
+	if err != nil {
+		return nil, err
+	}
+
+	relPaths := []string{}
+	for _, relPath := range splitNull(out) {
+		relPaths = append(relPaths, filepath.FromSlash(relPath))
+	}
+	return relPaths, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLsFiles(t *testing.T) {
+	out := []byte("100644 e69de29bb2d1d6434b8b29ae775ad8c2e48c5391 0\tREADME\x00" +
+		"100755 5716ca5987cbf97d6bb54920bea6adde242d87e6 0\tlib/a b.sh\x00")
+	files, err := parseLsFiles(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || files["README"] != "e69de29bb2d1d6434b8b29ae775ad8c2e48c5391" ||
+		files[filepath.Join("lib", "a b.sh")] != "5716ca5987cbf97d6bb54920bea6adde242d87e6" {
+		t.Error("unexpected files", files)
+	}
+
+	if _, err = parseLsFiles([]byte("garbage\x00")); err == nil {
+		t.Error("expected an error for bad output")
+	}
+}
+
+func TestGitBlobId(t *testing.T) {
+	file, err := ioutil.TempFile("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("hello\n")
+	file.Close()
+
+	// git hash-object of "hello\n".
+	id, err := gitBlobId(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "ce013625030ba8dba906f756967f9e9ca394464a" {
+		t.Error("unexpected blob id", id)
+	}
+}
+
+func TestGitFilesIgnored(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldRoot := root
+	root = dir
+	defer func() { root = oldRoot }()
+
+	os.MkdirAll(filepath.Join(dir, "node_modules"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte("node_modules/\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "main.c"), []byte("int main;\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "node_modules", "dep.js"), []byte("module.exports = 1\n"), 0644)
+	if _, err := git("init", "-q"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := GitFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if files["main.c"] == "" || files[".gitignore"] == "" {
+		t.Error("expected untracked files to be hashed, got", files)
+	}
+	if _, ok := files[filepath.Join("node_modules", "dep.js")]; ok {
+		t.Error("expected ignored files not to be hashed")
+	}
+
+	ignored, err := GitIgnored()
+	if err != nil || len(ignored) != 1 || ignored[0] != filepath.Join("node_modules", "dep.js") {
+		t.Error("expected the ignored file to be listed, got", ignored, err)
+	}
+}
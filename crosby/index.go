@@ -0,0 +1,21 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the interface entries are stored and looked up through.
+package main
+
+import "time"
+
+// Index is where entries are stored and found by their key.
+type Index interface {
+	// Find returns the entries with the same key as a source. They may
+	// have extra keys, so they're checked with Matches.
+	Find(s *Source) ([]Source, error)
+
+	// Insert stores a new entry.
+	Insert(s *Source) error
+
+	// RecordHit adds a hit to an entry's usage.
+	RecordHit(s *Source, saved time.Duration) error
+
+	// Delete removes an entry, its blobs are left in the store.
+	Delete(s *Source) error
+}
@@ -0,0 +1,104 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the keys command, used to manage signing and trusted keys.
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const keysUsage = `Usage: crosby keys <command>
+
+Commands:
+  list                 List the trusted keys
+  generate [path]      Create a signing key and trust it
+  trust <name> <key>   Trust a base64 encoded public key
+  revoke <name>        Remove a trusted key`
+
+// KeysCommand manages the signing key and trusted key list in the config
+// file in use.
+func KeysCommand(args []string) error {
+	if len(args) < 1 {
+		return errors.New(keysUsage)
+	}
+
+	// Only the keys in the config file being changed are written back, the
+	// list includes those trusted in ~/.crosby.json too.
+	cfg, err := ReadConfig(ConfigPath())
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		if len(config.TrustedKeys) == 0 {
+			fmt.Println("No trusted keys. Cache entries are restored unverified.")
+		}
+		for _, trusted := range config.TrustedKeys {
+			pub, err := ParsePublicKey(trusted.Key)
+			if err != nil {
+				return err
+			}
+			fmt.Println(KeyId(pub), trusted.Name, trusted.Key)
+		}
+		return nil
+	case "generate":
+		path := filepath.Join(os.Getenv(homeVar), ".crosbykey")
+		if len(args) > 1 {
+			path = args[1]
+		}
+		if _, err := os.Stat(path); err == nil {
+			return errors.New("A key already exists at " + path)
+		}
+
+		pub, err := GenerateKey(path)
+		if err != nil {
+			return err
+		}
+		name, _ := os.Hostname()
+		cfg.SigningKey = path
+		cfg.TrustedKeys = append(cfg.TrustedKeys, &TrustedKey{
+			Name: name,
+			Key:  base64.StdEncoding.EncodeToString(pub),
+		})
+
+		fmt.Println("Signing key written to", path)
+		fmt.Println("Public key:", base64.StdEncoding.EncodeToString(pub))
+	case "trust":
+		if len(args) < 3 {
+			return errors.New(keysUsage)
+		}
+		if _, err := ParsePublicKey(args[2]); err != nil {
+			return err
+		}
+		for _, trusted := range cfg.TrustedKeys {
+			if trusted.Name == args[1] {
+				return errors.New("A key named " + args[1] + " is already trusted")
+			}
+		}
+
+		cfg.TrustedKeys = append(cfg.TrustedKeys, &TrustedKey{Name: args[1], Key: args[2]})
+	case "revoke":
+		if len(args) < 2 {
+			return errors.New(keysUsage)
+		}
+
+		keys := cfg.TrustedKeys[:0]
+		for _, trusted := range cfg.TrustedKeys {
+			if trusted.Name != args[1] {
+				keys = append(keys, trusted)
+			}
+		}
+		if len(keys) == len(cfg.TrustedKeys) {
+			return errors.New("No trusted key named " + args[1])
+		}
+		cfg.TrustedKeys = keys
+	default:
+		return errors.New(keysUsage)
+	}
+
+	return cfg.Save()
+}
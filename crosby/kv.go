@@ -0,0 +1,489 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the key-value index in front of the entries, so entries are
+// found by their key digest instead of searching every input file.
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Kinds of key-value stores the index can use.
+const (
+	KVRedis     = "redis"
+	KVMemcached = "memcached"
+)
+
+// Memcached treats expiry times over 30 days as timestamps.
+const memcachedMaxExpiry = 30 * 24 * time.Hour
+
+// Largest entry kept in the index, bigger entries only have their id
+// indexed so they fit under memcached's 1MB item limit.
+const kvMaxEntrySize = 512 << 10
+
+// How long a miss is remembered, so cold keys aren't searched for in the
+// primary index on every lookup.
+var kvMissExpiry = time.Minute
+
+// IndexConfig is the key-value store entries are indexed in.
+type IndexConfig struct {
+	// Kind is redis or memcached.
+	Kind string `json:"kind"`
+
+	// Addr is the host and port of the server.
+	Addr string `json:"addr"`
+}
+
+// KeyValue is a key-value store, a missing key is nil and no error.
+type KeyValue interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, expiry time.Duration) error
+	Delete(key string) error
+}
+
+// entryFinder is an index that can read an entry by id. The key-value
+// index reads entries too big to keep in it from there.
+type entryFinder interface {
+	Index
+
+	// FindId returns the entry with an id.
+	FindId(id primitive.ObjectID) (*Source, error)
+
+	// Location returns where entries are stored, so ids indexed for
+	// another store aren't used.
+	Location() string
+}
+
+// KVIndex keeps the entries in another index in a key-value store keyed
+// by their key digest. Misses are looked up in the primary index, so
+// entries added without the key-value store are indexed the first time
+// they're found, and remembered for kvMissExpiry.
+type KVIndex struct {
+	Primary entryFinder
+	KV      KeyValue
+}
+
+// kvEntry is the value an entry is indexed as. Entry is left out if it's
+// too big, and Miss is set if the primary index didn't have the key.
+type kvEntry struct {
+	Id       string  `json:"id,omitempty"`
+	Location string  `json:"location"`
+	Entry    *Source `json:"entry,omitempty"`
+	Miss     bool    `json:"miss,omitempty"`
+}
+
+// NewKeyValue connects to the store in the config.
+func NewKeyValue(cfg *IndexConfig) (KeyValue, error) {
+	if cfg.Kind != KVRedis && cfg.Kind != KVMemcached {
+		return nil, errors.New("Unknown index kind " + cfg.Kind + ", must be redis or memcached.")
+	}
+	kv := &kvConn{addr: cfg.Addr, timeout: ConnectTimeout()}
+	if err := kv.dial(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Kind == KVRedis {
+		return &RedisKV{kv}, nil
+	}
+	return &MemcachedKV{kv}, nil
+}
+
+// kvKey returns the key an entry is indexed under.
+func kvKey(s *Source) string {
+	return "crosby:" + s.KeyDigest()
+}
+
+// Find reads the entry for the source's key. On a miss the primary index
+// is searched, anything found is indexed, and if nothing is the miss is.
+func (ki *KVIndex) Find(s *Source) ([]Source, error) {
+	data, err := ki.KV.Get(kvKey(s))
+	if err != nil {
+		fmt.Println("Unable to use the index, looking up the entry directly:", err)
+		return ki.Primary.Find(s)
+	}
+	indexed := ki.decode(data)
+	if indexed != nil && indexed.Miss {
+		return []Source{}, nil
+	}
+	if entry := ki.load(indexed); entry != nil {
+		return []Source{*entry}, nil
+	}
+
+	results, err := ki.Primary.Find(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		if err := ki.setMiss(s); err != nil {
+			fmt.Println("Unable to add the miss to the index:", err)
+		}
+	}
+	for i := range results {
+		if err := ki.Set(&results[i]); err != nil {
+			fmt.Println("Unable to add the entry to the index:", err)
+			break
+		}
+	}
+	return results, nil
+}
+
+// decode reads an indexed value. It's nil if nothing is indexed, or it's
+// for another store.
+func (ki *KVIndex) decode(data []byte) *kvEntry {
+	if data == nil {
+		return nil
+	}
+
+	indexed := &kvEntry{}
+	if err := json.Unmarshal(data, indexed); err != nil || indexed.Location != ki.Primary.Location() {
+		return nil
+	}
+	return indexed
+}
+
+// load returns the indexed entry, reading it from the primary index if
+// only its id is indexed. It's nil if the id no longer exists.
+func (ki *KVIndex) load(indexed *kvEntry) *Source {
+	if indexed == nil {
+		return nil
+	}
+	if indexed.Entry != nil {
+		return indexed.Entry
+	}
+
+	id, err := primitive.ObjectIDFromHex(indexed.Id)
+	if err != nil {
+		return nil
+	}
+
+	entry, err := ki.Primary.FindId(id)
+	if err != nil {
+		return nil
+	}
+	return entry
+}
+
+// Insert inserts an entry into the primary index, then indexes it. If it
+// can't be indexed it's still cached, and indexed the first time it's
+// looked up.
+func (ki *KVIndex) Insert(s *Source) error {
+	if err := ki.Primary.Insert(s); err != nil {
+		return err
+	}
+
+	if err := ki.Set(s); err != nil {
+		fmt.Println("Unable to add the entry to the index:", err)
+	}
+	return nil
+}
+
+// Set indexes an entry, expiring it with its TTL. Entries too big for the
+// key-value store only have their id indexed.
+func (ki *KVIndex) Set(s *Source) error {
+	data, err := json.Marshal(kvEntry{Id: s.Id.Hex(), Location: ki.Primary.Location(), Entry: s})
+	if err != nil {
+		return err
+	}
+	if len(data) > kvMaxEntrySize {
+		if data, err = json.Marshal(kvEntry{Id: s.Id.Hex(), Location: ki.Primary.Location()}); err != nil {
+			return err
+		}
+	}
+
+	var expiry time.Duration
+	if !s.Expires().IsZero() {
+		expiry = s.Expires().Sub(time.Now())
+		if expiry <= 0 {
+			return nil
+		}
+	}
+	return ki.KV.Set(kvKey(s), data, expiry)
+}
+
+// setMiss records that the primary index doesn't have the source's key.
+// Inserting an entry for the key replaces it.
+func (ki *KVIndex) setMiss(s *Source) error {
+	data, err := json.Marshal(kvEntry{Location: ki.Primary.Location(), Miss: true})
+	if err != nil {
+		return err
+	}
+
+	return ki.KV.Set(kvKey(s), data, kvMissExpiry)
+}
+
+// RecordHit records the hit in the primary index.
+func (ki *KVIndex) RecordHit(s *Source, saved time.Duration) error {
+	return ki.Primary.RecordHit(s, saved)
+}
+
+// Delete removes an entry from the index and the primary index.
+func (ki *KVIndex) Delete(s *Source) error {
+	if err := ki.KV.Delete(kvKey(s)); err != nil {
+		return err
+	}
+
+	return ki.Primary.Delete(s)
+}
+
+// kvConn is a connection to a key-value server using a text protocol. A
+// failed request closes the connection, since its reply may be half read,
+// and the next request reconnects.
+type kvConn struct {
+	mutex   sync.Mutex
+	addr    string
+	conn    net.Conn
+	rd      *bufio.Reader
+	timeout time.Duration
+}
+
+// dial connects to the server, the caller holds the mutex.
+func (kc *kvConn) dial() error {
+	conn, err := net.DialTimeout("tcp", kc.addr, kc.timeout)
+	if err != nil {
+		return err
+	}
+
+	kc.conn = conn
+	kc.rd = bufio.NewReader(conn)
+	return nil
+}
+
+// roundTrip writes a request and reads its reply with read, reconnecting
+// first if the last request failed.
+func (kc *kvConn) roundTrip(request []byte, read func(rd *bufio.Reader) error) error {
+	kc.mutex.Lock()
+	defer kc.mutex.Unlock()
+
+	if kc.conn == nil {
+		if err := kc.dial(); err != nil {
+			return err
+		}
+	}
+
+	kc.conn.SetDeadline(time.Now().Add(kc.timeout))
+	_, err := kc.conn.Write(request)
+	if err == nil {
+		err = read(kc.rd)
+	}
+	if err != nil {
+		kc.conn.Close()
+		kc.conn = nil
+	}
+	return err
+}
+
+// readLine reads a line without its \r\n.
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// RedisKV is a Redis server.
+type RedisKV struct {
+	*kvConn
+}
+
+// command sends a command and returns its reply, bulk replies are
+// returned as bytes and nil bulk replies as nil.
+func (rk *RedisKV) command(args ...string) (interface{}, error) {
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+
+	var reply interface{}
+	err := rk.roundTrip([]byte(request), func(rd *bufio.Reader) error {
+		var err error
+		reply, err = readRedisReply(rd)
+		return err
+	})
+	return reply, err
+}
+
+// readRedisReply reads a single reply.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New("redis: " + line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+
+		data := make([]byte, size+2)
+		if _, err = io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	}
+	return nil, errors.New("unexpected redis reply " + line)
+}
+
+// Get gets a key.
+func (rk *RedisKV) Get(key string) ([]byte, error) {
+	reply, err := rk.command("GET", key)
+	if err != nil || reply == nil {
+		return nil, err
+	}
+
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, errors.New("unexpected redis reply to GET")
+	}
+	return data, nil
+}
+
+// Set sets a key, expiring it if expiry is set.
+func (rk *RedisKV) Set(key string, value []byte, expiry time.Duration) error {
+	args := []string{"SET", key, string(value)}
+	if expiry > 0 {
+		args = append(args, "PX", strconv.FormatInt(int64(expiry/time.Millisecond)+1, 10))
+	}
+
+	_, err := rk.command(args...)
+	return err
+}
+
+// Delete deletes a key.
+func (rk *RedisKV) Delete(key string) error {
+	_, err := rk.command("DEL", key)
+	return err
+}
+
+// MemcachedKV is a memcached server.
+type MemcachedKV struct {
+	*kvConn
+}
+
+// Get gets a key.
+func (mk *MemcachedKV) Get(key string) ([]byte, error) {
+	var data []byte
+	err := mk.roundTrip([]byte("get "+key+"\r\n"), func(rd *bufio.Reader) error {
+		// VALUE <key> <flags> <bytes>, then the data and END.
+		line, err := readLine(rd)
+		if err != nil {
+			return err
+		}
+		if line == "END" {
+			return nil
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return errors.New("unexpected memcached reply " + line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return err
+		}
+
+		data = make([]byte, size+2)
+		if _, err = io.ReadFull(rd, data); err != nil {
+			return err
+		}
+		data = data[:size]
+		if line, err = readLine(rd); err != nil || line != "END" {
+			return errors.New("unexpected memcached reply " + line)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Set sets a key, expiring it if expiry is set. Keys that expire in more
+// than 30 days are kept until they're evicted.
+func (mk *MemcachedKV) Set(key string, value []byte, expiry time.Duration) error {
+	seconds := int64(0)
+	if expiry > 0 && expiry < memcachedMaxExpiry {
+		seconds = int64(expiry/time.Second) + 1
+	}
+	request := fmt.Sprintf("set %s 0 %d %d\r\n", key, seconds, len(value))
+
+	return mk.roundTrip(append(append([]byte(request), value...), '\r', '\n'), func(rd *bufio.Reader) error {
+		line, err := readLine(rd)
+		if err != nil {
+			return err
+		}
+		if line != "STORED" {
+			return errors.New("memcached: " + line)
+		}
+		return nil
+	})
+}
+
+// Delete deletes a key.
+func (mk *MemcachedKV) Delete(key string) error {
+	return mk.roundTrip([]byte("delete "+key+"\r\n"), func(rd *bufio.Reader) error {
+		line, err := readLine(rd)
+		if err != nil {
+			return err
+		}
+		if line != "DELETED" && line != "NOT_FOUND" {
+			return errors.New("memcached: " + line)
+		}
+		return nil
+	})
+}
+
+// ReindexCommand adds every entry to the index, for entries cached before
+// it was set up or while it was unreachable.
+func ReindexCommand(args []string) error {
+	if !CanWrite(mode) {
+		return ErrReadOnly
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("reindex")
+	if err != nil {
+		return err
+	}
+	ki, ok := index.(*KVIndex)
+	if !ok {
+		return errors.New("No index is set up, set index in the config.")
+	}
+
+	count := 0
+	err = mb.Each(nil, func(entry *Source) error {
+		count++
+		return ki.Set(entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Indexed", count, "entries.")
+	return nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryKV is a KeyValue in memory.
+type memoryKV map[string][]byte
+
+func (mk memoryKV) Get(key string) ([]byte, error) { return mk[key], nil }
+
+func (mk memoryKV) Set(key string, value []byte, expiry time.Duration) error {
+	mk[key] = value
+	return nil
+}
+
+func (mk memoryKV) Delete(key string) error {
+	delete(mk, key)
+	return nil
+}
+
+// memoryIndex is an Index in memory that counts lookups.
+type memoryIndex struct {
+	entries []Source
+	finds   int
+	findIds int
+}
+
+func (mi *memoryIndex) Find(s *Source) ([]Source, error) {
+	mi.finds++
+	results := []Source{}
+	for _, entry := range mi.entries {
+		if entry.KeyDigest() == s.KeyDigest() {
+			results = append(results, entry)
+		}
+	}
+	return results, nil
+}
+
+func (mi *memoryIndex) FindId(id primitive.ObjectID) (*Source, error) {
+	mi.findIds++
+	for i := range mi.entries {
+		if mi.entries[i].Id == id {
+			return &mi.entries[i], nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (mi *memoryIndex) Location() string { return "memory" }
+
+func (mi *memoryIndex) Insert(s *Source) error {
+	mi.entries = append(mi.entries, *s)
+	return nil
+}
+
+func (mi *memoryIndex) RecordHit(s *Source, saved time.Duration) error { return nil }
+
+func (mi *memoryIndex) Delete(s *Source) error {
+	for i := range mi.entries {
+		if mi.entries[i].Id == s.Id {
+			mi.entries = append(mi.entries[:i], mi.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func TestKVIndex(t *testing.T) {
+	primary := &memoryIndex{}
+	kv := memoryKV{}
+	ki := &KVIndex{primary, kv}
+
+	s := &Source{
+		Id:        primitive.NewObjectID(),
+		Namespace: "test",
+		Args:      []string{"make"},
+		Files:     map[string]string{"main_c": "a"},
+		Outputs:   []Output{{Id: primitive.NewObjectID(), Path: "main"}},
+	}
+	if err := ki.Insert(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.entries) != 1 || len(kv) != 1 {
+		t.Fatal("expected the entry in both indexes")
+	}
+	indexed := kvEntry{}
+	json.Unmarshal(kv[kvKey(s)], &indexed)
+	if indexed.Id != s.Id.Hex() || indexed.Location != "memory" || !reflect.DeepEqual(indexed.Entry, s) {
+		t.Error("expected the entry to be indexed, got", indexed)
+	}
+
+	// A hit is read from the index alone.
+	results, err := ki.Find(&Source{Namespace: "test", Args: []string{"make"}, Files: map[string]string{"main_c": "a"}})
+	if err != nil || len(results) != 1 || !reflect.DeepEqual(&results[0], s) {
+		t.Error("unexpected results", results, err)
+	}
+	if primary.finds != 0 || primary.findIds != 0 {
+		t.Error("expected a hit not to use the primary index, got", primary.finds, primary.findIds)
+	}
+
+	// Misses search the primary index once, then they're remembered.
+	missing := &Source{Namespace: "test", Args: []string{"make"}, Files: map[string]string{"main_c": "b"}}
+	for i := 0; i < 2; i++ {
+		results, err = ki.Find(missing)
+		if err != nil || len(results) != 0 {
+			t.Error("expected a miss, got", results, err)
+		}
+	}
+	if primary.finds != 1 {
+		t.Error("expected only the first miss to search the primary index, got", primary.finds)
+	}
+
+	// Caching the key replaces the miss.
+	filled := &Source{Id: primitive.NewObjectID(), Namespace: "test", Args: []string{"make"}, Files: map[string]string{"main_c": "b"}}
+	ki.Insert(filled)
+	results, err = ki.Find(missing)
+	if err != nil || len(results) != 1 || results[0].Id != filled.Id {
+		t.Error("expected the inserted entry to replace the miss, got", results, err)
+	}
+	ki.Delete(filled)
+
+	// Entries indexed by id are read from the primary index.
+	kv[kvKey(s)], _ = json.Marshal(kvEntry{Id: s.Id.Hex(), Location: "memory"})
+	results, err = ki.Find(s)
+	if err != nil || len(results) != 1 || results[0].Id != s.Id || primary.findIds != 1 {
+		t.Error("expected the entry to be read by id, got", results, err)
+	}
+
+	// Entries added without the index are indexed once they're found.
+	other := Source{Id: primitive.NewObjectID(), Namespace: "test", Args: []string{"make", "all"}}
+	primary.Insert(&other)
+	results, err = ki.Find(&Source{Namespace: "test", Args: []string{"make", "all"}})
+	if err != nil || len(results) != 1 || len(kv) != 2 {
+		t.Error("expected the primary's entries to be indexed, got", results, len(kv), err)
+	}
+	finds := primary.finds
+	results, err = ki.Find(&Source{Namespace: "test", Args: []string{"make", "all"}})
+	if err != nil || len(results) != 1 || results[0].Id != other.Id || primary.finds != finds {
+		t.Error("expected a hit from the index, got", results, err)
+	}
+
+	if err = ki.Delete(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.entries) != 1 || len(kv) != 1 {
+		t.Error("expected the entry to be removed from both indexes", len(primary.entries), len(kv))
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	rd := bufio.NewReader(strings.NewReader("+OK\r\n$5\r\nhello\r\n$-1\r\n:1\r\n-ERR wrong\r\n"))
+
+	expected := []interface{}{"OK", []byte("hello"), nil, int64(1)}
+	for _, want := range expected {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(reply, want) {
+			t.Errorf("expected %#v got %#v", want, reply)
+		}
+	}
+
+	if _, err := readRedisReply(rd); err == nil || err.Error() != "redis: ERR wrong" {
+		t.Error("expected an error reply, got", err)
+	}
+}
+
+func TestKVConnReconnect(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	oldConfig := config
+	config = &Config{}
+	defer func() { config = oldConfig }()
+
+	// The first connection is dropped, later ones answer every get.
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				conn.Close()
+				continue
+			}
+			go func() {
+				rd := bufio.NewReader(conn)
+				for {
+					if _, err := readLine(rd); err != nil {
+						conn.Close()
+						return
+					}
+					conn.Write([]byte("VALUE crosby:a 0 2\r\nok\r\nEND\r\n"))
+				}
+			}()
+		}
+	}()
+
+	kv, err := NewKeyValue(&IndexConfig{Kind: KVMemcached, Addr: listener.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kv.Get("crosby:a"); err == nil {
+		t.Fatal("expected the dropped connection to fail")
+	}
+	data, err := kv.Get("crosby:a")
+	if err != nil || string(data) != "ok" {
+		t.Error("expected the next get to reconnect, got", string(data), err)
+	}
+}
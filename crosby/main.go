@@ -3,7 +3,7 @@ package main
 
 import (
 	"bytes"
-	"crypto/md5"
+	"crypto/sha256"
 	"encoding/gob"
 	"encoding/json"
 	"errors"
@@ -12,28 +12,27 @@ import (
 	"github.com/thebyrd/pb"
 	"io"
 	"io/ioutil"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/Bowery/gopackages/keen"
 	"github.com/Bowery/gopackages/schemas"
-	"labix.org/v2/mgo"
-	"labix.org/v2/mgo/bson"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	schemabson "labix.org/v2/mgo/bson" // Developer ids still use mgo's bson.
 )
 
 var (
-	session       mgo.Session
-	db            *mgo.Database
-	c             *mgo.Collection
 	s             *Source
-	fs            *mgo.GridFS
+	store         Store
+	index         Index
 	progressBar   *pb.ProgressBar
 	startTime     time.Time
 	root          string
@@ -41,11 +40,15 @@ var (
 	dbHost        string
 	apiHost       string
 	homeVar       string
-	wg            sync.WaitGroup
 	saveWg        sync.WaitGroup
-	resultFileIds []bson.ObjectId
+	resultFileIds []primitive.ObjectID
+	resultOutputs []Output
+	resultPacks   []Pack
+	resultErr     error
+	resultMutex   sync.Mutex
 	keenC         *keen.Client
 	configPath    string
+	config        *Config
 )
 
 type Session struct {
@@ -55,11 +58,65 @@ type Session struct {
 }
 
 type Source struct {
-	Id        bson.ObjectId     `bson:"_id"`
-	ResultIds []bson.ObjectId   `bson:"results"`
-	Files     map[string]string `bson:"files"`
-	Arch      string            `bson:"arch"`
-	Args      string            `bson:"args,omitempty"`
+	Id        primitive.ObjectID   `bson:"_id"`
+	ResultIds []primitive.ObjectID `bson:"results"`
+	Files     map[string]string    `bson:"files"`
+	Arch      string               `bson:"arch"`
+	Platform  map[string]string    `bson:"platform,omitempty"`
+	Args      []string             `bson:"argv,omitempty"`
+	Env       map[string]string    `bson:"env,omitempty"`
+	Toolchain map[string]string    `bson:"toolchain,omitempty"`
+	Outputs   []Output             `bson:"outputs,omitempty"`
+	Packs     []Pack               `bson:"packs,omitempty"`
+	KeyId     string               `bson:"keyId,omitempty"`
+	Signature []byte               `bson:"signature,omitempty"`
+
+	// Command is the command as it was run, Args are its normalised
+	// arguments that are part of the key.
+	Command string `bson:"args,omitempty"`
+
+	// Dir is the directory the command was run in relative to the root,
+	// empty if it was run in the root.
+	Dir string `bson:"dir,omitempty"`
+
+	// Namespace scopes the entry to a team or product. Key is the digest
+	// of the whole cache key, Project is the project the command was run
+	// in and TTL is how long the entry can be used.
+	Namespace string        `bson:"namespace"`
+	Key       string        `bson:"key,omitempty"`
+	Project   string        `bson:"project,omitempty"`
+	TTL       time.Duration `bson:"ttl,omitempty"`
+
+	// Usage of the entry, RunDuration is how long the command took and
+	// TimeSaved is the total of it less the restore time over every hit.
+	Created     time.Time     `bson:"created,omitempty"`
+	RunDuration time.Duration `bson:"runDuration,omitempty"`
+	LastHit     time.Time     `bson:"lastHit,omitempty"`
+	Hits        int           `bson:"hits"`
+	TimeSaved   time.Duration `bson:"timeSaved"`
+
+	// names are the original names of the keys in Files, Env and
+	// Toolchain, which have dots replaced. They're only known for the
+	// source computed by Fingerprint.
+	names map[string]string
+}
+
+// Output is a file written by the command, Digest is the sha256 of its
+// contents before they're encoded with Codec. Small outputs are stored in
+// a pack, in which case Pack is set instead of Id. Large outputs are
+// split into Parts instead.
+type Output struct {
+	Id     primitive.ObjectID `bson:"id,omitempty"`
+	Pack   primitive.ObjectID `bson:"pack,omitempty"`
+	Path   string             `bson:"path"`
+	Digest string             `bson:"digest"`
+	Codec  string             `bson:"codec,omitempty"`
+	Size   int64              `bson:"size"`
+	Parts  []Part             `bson:"parts,omitempty"`
+
+	// Rewritten outputs have the root replaced with a placeholder, Digest
+	// is of the rewritten contents.
+	Rewritten bool `bson:"rewritten,omitempty"`
 }
 
 func init() {
@@ -74,16 +131,6 @@ func init() {
 		apiHost = "localhost:4000" // where broome runs
 	}
 
-	session, err := mgo.Dial(dbHost)
-	if err != nil {
-		fmt.Println(err)
-		panic("could not connect to crosby")
-	}
-	session.SetSocketTimeout(time.Hour)
-	db = session.DB("crosby")
-	c = db.C("sources")
-	fs = db.GridFS("fs")
-
 	homeVar = "HOME"
 	if runtime.GOOS == "windows" {
 		homeVar = "USERPROFILE"
@@ -135,10 +182,10 @@ func CreateDeveloper() (*schemas.Developer, error) {
 	u := &schemas.Developer{
 		Name:  strName,
 		Email: strEmail,
-		ID:    bson.NewObjectId(),
+		ID:    schemabson.NewObjectId(),
 	}
 
-	res, err := http.PostForm("http://"+apiHost+"/signup",
+	res, err := httpClient.PostForm("http://"+apiHost+"/signup",
 		url.Values{
 			"name":  {u.Name},
 			"email": {u.Email},
@@ -195,7 +242,7 @@ func ValidateSession() error {
 		return err
 	}
 
-	res, err := http.Get("http://" + apiHost + "/session/" + dev.ID.Hex())
+	res, err := httpClient.Get("http://" + apiHost + "/session/" + dev.ID.Hex())
 	if err != nil {
 		return err
 	}
@@ -234,217 +281,226 @@ func ValidateSession() error {
 }
 
 func saveResult(path, relPath, sourceId string) error {
-	file, err := fs.Create(sourceId + ":" + relPath)
+	codec, err := ChooseCodec(path)
 	if err != nil {
 		return err
 	}
-	content, err := os.Open(path)
+
+	file, err := store.Create(sourceId+":"+relPath, bson.M{"codec": codec})
 	if err != nil {
 		return err
 	}
+	content, _, rewritten, err := openOutput(path, relPath)
+	if err != nil {
+		return abortFile(file, err)
+	}
 	defer content.Close()
 
-	if _, err = io.Copy(file, content); err != nil {
-		return err
+	encoder, err := Compress(file, codec)
+	if err != nil {
+		return abortFile(file, err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(encoder, hash), content)
+	if err != nil {
+		return abortFile(file, err)
+	}
+	if err = encoder.Close(); err != nil {
+		return abortFile(file, err)
 	}
 	if err = file.Close(); err != nil {
 		return err
 	}
-	resultFileIds = append(resultFileIds, file.Id().(bson.ObjectId))
+
+	id := file.Id()
+	resultMutex.Lock()
+	resultFileIds = append(resultFileIds, id)
+	resultOutputs = append(resultOutputs, Output{
+		Id:        id,
+		Path:      relPath,
+		Digest:    fmt.Sprintf("%x", hash.Sum(nil)),
+		Codec:     codec,
+		Size:      size,
+		Rewritten: rewritten,
+	})
+	resultMutex.Unlock()
 	saveWg.Done()
 	return nil
 }
 
 func AddToCache(s *Source) {
-	fmt.Println("Result not found in cache. Running command (may take a while)...")
+	if !CanWrite(mode) {
+		fmt.Println("Result not found in cache. Running command, the cache is read-only so the result won't be saved.")
+		os.Exit(RunUncached())
+	}
+
+	if CanRead(mode) {
+		fmt.Println("Result not found in cache. Running command (may take a while)...")
+	} else {
+		fmt.Println("Running command, the cache is write-only (may take a while)...")
+	}
 	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 
+	runStart := time.Now()
 	err := cmd.Run()
 	if err != nil {
 		fmt.Println("Running command failed:", err)
 		return
 	}
-	fmt.Println("Command has finished. Adding result in cache.")
+	s.Id = primitive.NewObjectID()
+	s.RunDuration = time.Since(runStart)
 
-	sourceId := bson.NewObjectId()
-	s.Id = sourceId
+	relPaths, err := NewOutputs(s)
+	if err != nil {
+		fmt.Println("Failed to walk Directory. Please make sure this program has appropriate permissions.")
+		fmt.Println(err)
+		return
+	}
 
-	// insert files that have been created since start
-	if err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+	if BackgroundUpload() {
+		if err := Spool(s, relPaths); err != nil {
+			fmt.Println("Unable to queue result for upload. The result was not cached.")
+			fmt.Println(err)
+			return
+		}
+		fmt.Println("Command has finished. The result will be added to the cache in the background.")
+		StartUploader()
+		return
+	}
+
+	fmt.Println("Command has finished. Adding result in cache.")
+	if err := UploadResult(s, root, relPaths); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// NewOutputs returns the paths of files that weren't inputs of the source.
+func NewOutputs(s *Source) ([]string, error) {
+	relPaths := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		relPath, _ := filepath.Rel(root, path)
 		// ignore hidden directories and .git
 		if relPath == "." || strings.Contains(relPath, ".git") || info.IsDir() {
 			return nil
 		}
 
+		if modTime, ok := existing[relPath]; ok && modTime.Equal(info.ModTime()) {
+			return nil // unchanged file outside the inputs
+		}
 		if s.Files[strings.Replace(relPath, ".", "_", -1)] == "" { // check if the file was in the target map
-
-			fmt.Println("- Adding " + relPath + " to cache.")
-			saveWg.Add(1)
-			go backoff.Retry(func() error {
-				return saveResult(path, relPath, sourceId.Hex())
-			}, backoff.NewExponentialBackOff())
+			relPaths = append(relPaths, relPath)
 		}
 		return nil
-	}); err != nil {
-		fmt.Println("Failed to walk Directory. Please make sure this program has appropriate permissions.")
-		fmt.Println(err)
-		return
-	}
-	saveWg.Wait()
-
-	// insert
-	s.ResultIds = resultFileIds
-	if err = c.Insert(s); err != nil {
-		fmt.Println("Error inserting document into database. Please make sure you are connected to the internet.")
-		fmt.Println(err)
-	}
-	return
-}
-
-func WriteFromCache(s *Source) {
-	resultId := s.Id.Hex()
-	targetResults := []bson.M{}
-	if err := fs.Find(bson.M{"_id": bson.M{"$in": s.ResultIds}}).All(&targetResults); err != nil {
-		fmt.Println("Unable to find cached files with ids", s.ResultIds, ". Please contact support@bowery.io.")
-		fmt.Println(err)
-		return
-	}
-	if len(targetResults) < 1 {
-		fmt.Println("This command does not update your current directory. No action was taken.")
-		os.Exit(1)
-	} else {
-		fmt.Println("Writing Files from Crosby ...")
-	}
-	progressBar = pb.StartNew(len(targetResults))
+	})
 
-	for _, f := range targetResults {
-		wg.Add(1)
-		go writeFile(f, resultId)
-	}
-	wg.Wait()
+	return relPaths, err
 }
 
-func writeFile(f map[string]interface{}, resultId string) {
-	defer wg.Done()
+// UploadResult uploads the outputs of a source from dir and inserts it.
+// Small files are packed together once the others have started. If the
+// result can't be cached the blobs already uploaded are removed.
+func UploadResult(s *Source, dir string, relPaths []string) error {
+	if !CanWrite(mode) {
+		return ErrReadOnly
+	}
+	sourceId := s.Id
+	resultFileIds, resultOutputs, resultPacks, resultErr = nil, nil, nil, nil
+
+	packer := &Packer{}
+	for _, relPath := range relPaths {
+		path := filepath.Join(dir, relPath)
+		relPath := relPath
+		info, err := os.Stat(path)
+		if err != nil {
+			failUpload(relPath, err)
+			continue
+		}
 
-	file, err := fs.OpenId(f["_id"])
-	if err != nil {
-		// TODO (thebyrd) remove id from cache and handle this gracefully.
-		fmt.Println("Unable to find cached file with id ", f["_id"], ". Please contact support@bowery.io.")
-		fmt.Println(err)
-		return
-	}
+		fmt.Println("- Adding " + relPath + " to cache.")
+		if info.Size() < packThreshold {
+			packer.Add(path, relPath, info)
+			continue
+		}
 
-	outPath := strings.Replace(f["filename"].(string), resultId+":", "", -1)
-	if err = os.MkdirAll(filepath.Dir(outPath), os.ModePerm|os.ModeDir); err != nil {
-		fmt.Println(err)
-		return
-	}
+		if info.Size() >= chunkThreshold {
+			saveWg.Add(1)
+			go saveChunked(path, relPath, sourceId.Hex(), info.Size())
+			continue
+		}
 
-	outfile, err := os.Create(outPath)
-	if err != nil {
-		fmt.Println("Failed to create file. Please make sure this program has appropriate permission.")
-		fmt.Println(err)
-		return
+		saveWg.Add(1)
+		go func() {
+			if err := backoff.Retry(func() error {
+				return saveResult(path, relPath, sourceId.Hex())
+			}, backoff.NewExponentialBackOff()); err != nil {
+				failUpload(relPath, err)
+				saveWg.Done()
+			}
+		}()
+	}
+
+	for i, files := range packer.packs {
+		n, files := i, files
+		saveWg.Add(1)
+		go func() {
+			if err := backoff.Retry(func() error {
+				return savePack(files, sourceId.Hex(), n)
+			}, backoff.NewExponentialBackOff()); err != nil {
+				failUpload("pack "+strconv.Itoa(n), err)
+				saveWg.Done()
+			}
+		}()
 	}
-	defer outfile.Close()
+	saveWg.Wait()
 
-	if _, err = io.Copy(outfile, file); err != nil {
-		fmt.Println("Failed to copy file from cache to your computer. Please make sure this program has appropriate permission.")
-		fmt.Println(err)
-		return
+	if resultErr != nil {
+		removeBlobs(resultFileIds)
+		return errors.New("Some files couldn't be uploaded. The result was not cached.")
 	}
 
-	if err = file.Close(); err != nil {
-		fmt.Println("Failed to close resulting file. Please make sure this program has appropriate permission.")
-		fmt.Println(err)
-		return
+	// insert
+	s.ResultIds = resultFileIds
+	s.Outputs = resultOutputs
+	s.Packs = resultPacks
+	if config.SigningKey != "" {
+		priv, err := ReadPrivateKey(config.SigningKey)
+		if err != nil {
+			removeBlobs(resultFileIds)
+			return errors.New("Unable to read signing key. The result was not cached.\n" + err.Error())
+		}
+		SignSource(s, priv)
 	}
 
-	if err = exec.Command("chmod", "+x", outPath).Run(); err != nil {
-		fmt.Println("Failed to make resulting file executable. Please make sure this program has appropriate permission.")
-		fmt.Println(err)
-		return
+	s.Created = time.Now()
+	if err := index.Insert(s); err != nil {
+		removeBlobs(resultFileIds)
+		return errors.New("Error inserting document into database. Please make sure you are connected to the internet.\n" + err.Error())
 	}
-	progressBar.Increment()
+	return nil
 }
 
 func main() {
-	defer session.Close()
-
-	if len(os.Args) <= 1 {
-		fmt.Println("Error: Must Specify Command to Run")
-		fmt.Println("Usage: crosby <command>")
-		return
+	var err error
+	config, err = LoadConfig()
+	if err != nil {
+		fmt.Println("Failed to read config "+ConfigPath()+":", err)
+		os.Exit(1)
 	}
 
-	if err := ValidateSession(); err != nil {
+	mode, err = CacheMode()
+	if err != nil {
 		fmt.Println(err)
-		return
-	}
-
-	s = &Source{
-		Arch:  runtime.GOOS + "-" + runtime.GOARCH,
-		Args:  strings.Join(args, " "),
-		Files: map[string]string{},
-	}
-
-	if err := filepath.Walk(root, func(path string, f os.FileInfo, err error) error {
-		relPath, _ := filepath.Rel(root, path)
-		// ignore hidden directories and .
-		if relPath == "." || strings.Contains(relPath, ".git") {
-			return nil
-		}
-
-		content, _ := ioutil.ReadFile(path)
-		s.Files[strings.Replace(relPath, ".", "_", -1)] = fmt.Sprintf("%x", md5.Sum(content))
-		return nil
-	}); err != nil {
-		fmt.Println("Failed:", err)
-		return
-	}
-
-	query := bson.M{}
-	for key := range s.Files {
-		query["files."+key] = s.Files[key]
-	}
-	query["arch"] = s.Arch
-	query["args"] = s.Args
-
-	results := []Source{}
-	err := c.Find(query).All(&results)
-	notFound := err != nil || len(results) == 0
-
-	for _, result := range results {
-		if len(result.Files) == len(s.Files) {
-			s = &result
-			notFound = false
-			break
-		}
-	}
-
-	info := map[string]interface{}{
-		"command": os.Args[1],
-		"args":    strings.Join(args[1:], " "), // just the arguments to the command
-		"os":      runtime.GOOS,
-		"arch":    runtime.GOARCH,
+		os.Exit(1)
 	}
 
-	if notFound {
-		AddToCache(s)
-		info["cacheHit"] = false
-	} else if err == nil {
-		WriteFromCache(s)
-		progressBar.FinishPrint("Done!")
-		info["cacheHit"] = true
-	} else {
-		fmt.Println("Error connecting to database. Please make sure you are connected to the internet and try again.")
+	cmd, cmdArgs := FindCommand(os.Args[1:])
+	err = cmd.Run(cmdArgs)
+	CloseStore()
+	if err != nil {
 		fmt.Println(err)
+		os.Exit(1)
 	}
-
-	info["duration"] = time.Now().Sub(startTime).String()
-	keenC.AddEvent("crosby command", info) // failed commands will have no info regarding duration or cache hit
 }
@@ -0,0 +1,90 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the cache modes, which limit reading or writing the cache.
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Cache modes.
+const (
+	ModeReadWrite = "read-write" // Restore hits and cache misses.
+	ModeReadOnly  = "read-only"  // Restore hits, never write.
+	ModeWriteOnly = "write-only" // Always run the command and cache it.
+	ModeDisabled  = "disabled"   // Just run the command.
+)
+
+var (
+	ErrReadOnly  = errors.New("the cache is read-only")
+	ErrWriteOnly = errors.New("the cache is write-only")
+)
+
+// mode is the cache mode set by --mode.
+var mode string
+
+// CacheMode returns the mode from the flag, env or config, in that order.
+func CacheMode() (string, error) {
+	m := mode
+	if m == "" {
+		m = os.Getenv("CROSBY_MODE")
+	}
+	if m == "" {
+		m = config.Mode
+	}
+
+	switch m {
+	case "":
+		return ModeReadWrite, nil
+	case ModeReadWrite, ModeReadOnly, ModeWriteOnly, ModeDisabled:
+		return m, nil
+	}
+	return "", errors.New("Unknown cache mode " + m + ", must be one of read-write, read-only, write-only or disabled.")
+}
+
+// CanRead checks if the mode allows restoring from the cache.
+func CanRead(m string) bool {
+	return m == ModeReadWrite || m == ModeReadOnly
+}
+
+// CanWrite checks if the mode allows writing to the cache.
+func CanWrite(m string) bool {
+	return m == ModeReadWrite || m == ModeWriteOnly
+}
+
+// ModeStore wraps a store so it can't be used against the cache mode.
+type ModeStore struct {
+	Mode  string
+	Store Store
+}
+
+// Create creates a blob if the mode allows writes.
+func (ms *ModeStore) Create(name string, meta bson.M) (Blob, error) {
+	if !CanWrite(ms.Mode) {
+		return nil, ErrReadOnly
+	}
+
+	return ms.Store.Create(name, meta)
+}
+
+// Open opens a blob if the mode allows reads.
+func (ms *ModeStore) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	if !CanRead(ms.Mode) {
+		return nil, ErrWriteOnly
+	}
+
+	return ms.Store.Open(id)
+}
+
+// Remove deletes a blob if the mode allows writes.
+func (ms *ModeStore) Remove(id primitive.ObjectID) error {
+	if !CanWrite(ms.Mode) {
+		return ErrReadOnly
+	}
+
+	return ms.Store.Remove(id)
+}
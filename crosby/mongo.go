@@ -0,0 +1,332 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the Mongo backend, entries are stored in a collection and blobs
+// in GridFS.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Time allowed for a query, and for scans of every entry or transferring
+// a blob.
+const (
+	mongoTimeout     = time.Minute
+	mongoLongTimeout = time.Hour
+)
+
+// MongoConfig is how to connect to Mongo for the mongo backend.
+type MongoConfig struct {
+	// URI is the connection string, defaulting to the Crosby database.
+	URI string `json:"uri,omitempty"`
+
+	// Database is the database entries and blobs are stored in,
+	// defaulting to crosby.
+	Database string `json:"database,omitempty"`
+
+	// Username is the user to authenticate as, the password is read from
+	// CROSBY_MONGO_PASSWORD. AuthSource is the database the user is
+	// defined in, defaulting to Database.
+	Username   string `json:"username,omitempty"`
+	AuthSource string `json:"authSource,omitempty"`
+
+	// TLS connects over TLS. CAFile is a PEM file of the certificates to
+	// trust instead of the system's.
+	TLS    bool   `json:"tls,omitempty"`
+	CAFile string `json:"caFile,omitempty"`
+}
+
+// MongoBackend stores entries in a Mongo collection and blobs in GridFS.
+// It's an Index and a Store, and holds its own connection which is closed
+// with Close.
+type MongoBackend struct {
+	Client  *mongo.Client
+	Name    string
+	Entries *mongo.Collection
+	Files   *mongo.Collection
+	Bucket  *gridfs.Bucket
+}
+
+// ConnectMongo connects to Mongo, failing if a server can't be reached
+// within timeout. A nil config uses the defaults.
+func ConnectMongo(cfg *MongoConfig, timeout time.Duration) (*MongoBackend, error) {
+	if cfg == nil {
+		cfg = &MongoConfig{}
+	}
+	uri := cfg.URI
+	if uri == "" {
+		uri = "mongodb://" + dbHost
+	}
+	name := cfg.Database
+	if name == "" {
+		name = "crosby"
+	}
+
+	opts := options.Client().ApplyURI(uri).
+		SetConnectTimeout(timeout).
+		SetServerSelectionTimeout(timeout).
+		SetSocketTimeout(mongoLongTimeout)
+	if cfg.Username != "" {
+		source := cfg.AuthSource
+		if source == "" {
+			source = name
+		}
+		opts.SetAuth(options.Credential{
+			AuthSource:  source,
+			Username:    cfg.Username,
+			Password:    os.Getenv("CROSBY_MONGO_PASSWORD"),
+			PasswordSet: true,
+		})
+	}
+	if cfg.TLS || cfg.CAFile != "" {
+		tlsConfig, err := mongoTLSConfig(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	client, err := mongo.Connect(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Ping(ctx, readpref.Primary()); err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	db := client.Database(name)
+	bucket, err := gridfs.NewBucket(db)
+	if err != nil {
+		client.Disconnect(context.Background())
+		return nil, err
+	}
+
+	return &MongoBackend{
+		Client:  client,
+		Name:    name,
+		Entries: db.Collection("sources"),
+		Files:   db.Collection("fs.files"),
+		Bucket:  bucket,
+	}, nil
+}
+
+// mongoTLSConfig returns the TLS config trusting the certificates in
+// caFile, or the system's if it's empty.
+func mongoTLSConfig(caFile string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	if caFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.RootCAs = x509.NewCertPool()
+	if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + caFile)
+	}
+
+	return tlsConfig, nil
+}
+
+// Close disconnects from Mongo.
+func (mb *MongoBackend) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	return mb.Client.Disconnect(ctx)
+}
+
+// Find queries the collection for entries with the same key.
+func (mb *MongoBackend) Find(s *Source) ([]Source, error) {
+	return mb.FindAll(s.Query(), nil)
+}
+
+// FindAll returns the entries matching a filter.
+func (mb *MongoBackend) FindAll(filter interface{}, opts *options.FindOptions) ([]Source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	if opts == nil {
+		opts = options.Find()
+	}
+	cursor, err := mb.Entries.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Source{}
+	err = cursor.All(ctx, &results)
+	return results, err
+}
+
+// FindId returns the entry with an id.
+func (mb *MongoBackend) FindId(id primitive.ObjectID) (*Source, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	entry := &Source{}
+	err := mb.Entries.FindOne(ctx, bson.M{"_id": id}).Decode(entry)
+	if err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Location returns the database and collection entries are stored in.
+func (mb *MongoBackend) Location() string {
+	return mb.Name + ".sources"
+}
+
+// Each calls fn with every entry, with only the fields in projection if
+// it's set.
+func (mb *MongoBackend) Each(projection bson.M, fn func(entry *Source) error) error {
+	return mb.EachMatching(bson.M{}, projection, fn)
+}
+
+// EachMatching calls fn with every entry matching a filter, with only the
+// fields in projection if it's set.
+func (mb *MongoBackend) EachMatching(filter, projection bson.M, fn func(entry *Source) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoLongTimeout)
+	defer cancel()
+
+	opts := options.Find()
+	if projection != nil {
+		opts.SetProjection(projection)
+	}
+	cursor, err := mb.Entries.Find(ctx, filter, opts)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		entry := &Source{}
+		if err := cursor.Decode(entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// Insert inserts an entry into the collection.
+func (mb *MongoBackend) Insert(s *Source) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := mb.Entries.InsertOne(ctx, s)
+	return err
+}
+
+// RecordHit updates the usage of an entry in a single update.
+func (mb *MongoBackend) RecordHit(s *Source, saved time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := mb.Entries.UpdateByID(ctx, s.Id, bson.M{
+		"$set": bson.M{"lastHit": s.LastHit},
+		"$inc": bson.M{"hits": 1, "timeSaved": saved},
+	})
+	return err
+}
+
+// Delete removes an entry from the collection.
+func (mb *MongoBackend) Delete(s *Source) error {
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+
+	_, err := mb.Entries.DeleteOne(ctx, bson.M{"_id": s.Id})
+	return err
+}
+
+// mongoBlob is a GridFS file being written.
+type mongoBlob struct {
+	*gridfs.UploadStream
+	id      primitive.ObjectID
+	aborted bool
+}
+
+// Id returns the id of the GridFS file.
+func (b *mongoBlob) Id() primitive.ObjectID {
+	return b.id
+}
+
+// Abort discards the chunks written so far.
+func (b *mongoBlob) Abort() {
+	b.aborted = true
+	b.UploadStream.Abort()
+}
+
+// Close finishes the file, unless it was aborted.
+func (b *mongoBlob) Close() error {
+	if b.aborted {
+		return nil
+	}
+
+	return b.UploadStream.Close()
+}
+
+// Create creates a GridFS file with the given metadata.
+func (mb *MongoBackend) Create(name string, meta bson.M) (Blob, error) {
+	id := primitive.NewObjectID()
+	stream, err := mb.Bucket.OpenUploadStreamWithID(id, name, options.GridFSUpload().SetMetadata(meta))
+	if err != nil {
+		return nil, err
+	}
+	stream.SetWriteDeadline(time.Now().Add(mongoLongTimeout))
+
+	return &mongoBlob{UploadStream: stream, id: id}, nil
+}
+
+// Open opens a GridFS file by id.
+func (mb *MongoBackend) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	stream, err := mb.Bucket.OpenDownloadStream(id)
+	if err != nil {
+		return nil, err
+	}
+	stream.SetReadDeadline(time.Now().Add(mongoLongTimeout))
+
+	return stream, nil
+}
+
+// Remove deletes a GridFS file by id.
+func (mb *MongoBackend) Remove(id primitive.ObjectID) error {
+	return mb.Bucket.Delete(id)
+}
+
+// requireMongo returns the mongo backend, which commands that search or
+// remove entries need. The other backends can't list entries, so they're
+// expired by the server instead.
+func requireMongo(name string) (*MongoBackend, error) {
+	primary := index
+	if ki, ok := primary.(*KVIndex); ok {
+		primary = ki.Primary
+	}
+
+	mb, ok := primary.(*MongoBackend)
+	if !ok {
+		return nil, errors.New("crosby " + name + " needs the mongo backend. Entries in the " +
+			config.Backend + " backend can't be listed, use the server's eviction or a lifecycle rule on the bucket to expire them.")
+	}
+	return mb, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMongoTLSConfig(t *testing.T) {
+	tlsConfig, err := mongoTLSConfig("")
+	if err != nil || tlsConfig.RootCAs != nil {
+		t.Error("expected the system CAs, got", tlsConfig, err)
+	}
+
+	file, err := ioutil.TempFile("", "crosby-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("not a certificate")
+	file.Close()
+
+	if _, err := mongoTLSConfig(file.Name()); err == nil {
+		t.Error("expected an error for a file without certificates")
+	}
+	if _, err := mongoTLSConfig(file.Name() + "-missing"); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestRequireMongo(t *testing.T) {
+	oldIndex, oldConfig := index, config
+	defer func() { index, config = oldIndex, oldConfig }()
+
+	config = &Config{Backend: BackendS3}
+	index = &S3Cache{}
+	if _, err := requireMongo("gc"); err == nil {
+		t.Error("expected the s3 backend to be rejected")
+	}
+
+	mb := &MongoBackend{}
+	index = &KVIndex{Primary: mb}
+	if found, err := requireMongo("gc"); err != nil || found != mb {
+		t.Error("expected the mongo backend behind the index, got", found, err)
+	}
+}
+
+func TestIsNotFound(t *testing.T) {
+	if !IsNotFound(ErrS3NotFound) || !IsNotFound(os.ErrNotExist) {
+		t.Error("expected missing blobs to be not found")
+	}
+	if IsNotFound(ErrReadOnly) {
+		t.Error("expected other errors to be reported")
+	}
+}
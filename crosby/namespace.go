@@ -0,0 +1,54 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the namespaces entries are scoped to.
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// DefaultNamespace is used when there's no namespace configured and no git
+// remote to infer it from.
+const DefaultNamespace = "default"
+
+// Namespace returns the namespace entries are read from and written to,
+// from CROSBY_NAMESPACE, the config or the git remote, in that order.
+func Namespace() string {
+	if env := os.Getenv("CROSBY_NAMESPACE"); env != "" {
+		return env
+	}
+	if config.Namespace != "" {
+		return config.Namespace
+	}
+
+	cmd := exec.Command("git", "config", "--get", "remote.origin.url")
+	cmd.Dir = root
+	url, err := cmd.Output()
+	if err == nil {
+		if namespace := remoteNamespace(string(url)); namespace != "" {
+			return namespace
+		}
+	}
+
+	return DefaultNamespace
+}
+
+// remoteNamespace turns a git remote url into a namespace, so
+// git@github.com:org/repo.git and https://github.com/org/repo are both
+// github.com/org/repo.
+func remoteNamespace(url string) string {
+	url = strings.TrimSpace(url)
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	} else if i := strings.Index(url, ":"); i >= 0 {
+		// scp style, host:path.
+		url = url[:i] + "/" + url[i+1:]
+	}
+	if i := strings.Index(url, "@"); i >= 0 && i < strings.Index(url+"/", "/") {
+		url = url[i+1:]
+	}
+
+	url = strings.TrimSuffix(strings.TrimSuffix(url, "/"), ".git")
+	return strings.ToLower(url)
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRemoteNamespace(t *testing.T) {
+	cases := map[string]string{
+		"git@github.com:Bowery/crosby.git\n":        "github.com/bowery/crosby",
+		"https://github.com/Bowery/crosby":          "github.com/bowery/crosby",
+		"https://user@github.com/Bowery/crosby/":    "github.com/bowery/crosby",
+		"ssh://git@git.example.com:22/team/app.git": "git.example.com:22/team/app",
+		"": "",
+	}
+
+	for url, expected := range cases {
+		if namespace := remoteNamespace(url); namespace != expected {
+			t.Errorf("%q expected %q got %q", url, expected, namespace)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the fallback used when the cache or API can't be reached.
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Policies for when crosby is offline.
+const (
+	OfflineFail   = "fail"   // Exit without running the command.
+	OfflineWarn   = "warn"   // Print a warning and run the command.
+	OfflineSilent = "silent" // Run the command.
+)
+
+// Default time to wait when connecting to the cache or API.
+const defaultConnectTimeout = 5 * time.Second
+
+// httpClient is used for requests to the API, with the connect timeout.
+var httpClient = &http.Client{}
+
+// OfflinePolicy returns the policy from the env or config, defaulting to
+// warn.
+func OfflinePolicy() string {
+	policy := os.Getenv("CROSBY_OFFLINE")
+	if policy == "" {
+		policy = config.Offline
+	}
+
+	switch policy {
+	case OfflineFail, OfflineSilent:
+		return policy
+	}
+	return OfflineWarn
+}
+
+// ConnectTimeout returns the timeout for connecting to the cache or API.
+func ConnectTimeout() time.Duration {
+	if config.ConnectTimeout > 0 {
+		return time.Duration(config.ConnectTimeout) * time.Second
+	}
+
+	return defaultConnectTimeout
+}
+
+// IsNetworkError checks if an error came from being unable to reach a
+// server, rather than the server responding with an error.
+func IsNetworkError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if err == nil {
+		return false
+	}
+
+	_, ok := err.(net.Error)
+	return ok || err == io.EOF || err == context.DeadlineExceeded ||
+		mongo.IsNetworkError(err) || mongo.IsTimeout(err) ||
+		strings.HasPrefix(err.Error(), "server selection error")
+}
+
+// Degrade applies the offline policy after err. If the command should
+// be run uncached it's run and crosby exits with its status.
+func Degrade(err error) {
+	policy := OfflinePolicy()
+	switch policy {
+	case OfflineFail:
+		fmt.Println("Unable to reach Crosby. Please make sure you are connected to the internet and try again.")
+		fmt.Println(err)
+		os.Exit(1)
+	case OfflineWarn:
+		fmt.Println("Unable to reach Crosby, running command without the cache.")
+		fmt.Println(err)
+	}
+
+	os.Exit(RunUncached())
+}
+
+// RunUncached runs the command directly, returning its exit status.
+func RunUncached() int {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	err := cmd.Run()
+	if err == nil {
+		return 0
+	}
+
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return status.ExitStatus()
+		}
+	}
+	fmt.Println("Running command failed:", err)
+	return 1
+}
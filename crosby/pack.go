@@ -0,0 +1,184 @@
+// Copyright 2014 Bowery, Inc.
+// Contains routines to bundle small outputs into packs.
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Files smaller than this are bundled into packs instead of being stored
+// as their own blob.
+var packThreshold int64 = 1 << 20
+
+// Packs are closed once their contents reach this size.
+const packSize = 64 << 20
+
+// Pack is a blob holding a tar stream of small outputs. The outputs it
+// contains refer to it by Id.
+type Pack struct {
+	Id    primitive.ObjectID `bson:"id"`
+	Codec string             `bson:"codec,omitempty"`
+	Count int                `bson:"count"`
+}
+
+// packFile is a file waiting to be packed.
+type packFile struct {
+	path    string
+	relPath string
+	info    os.FileInfo
+}
+
+// Packer groups files into packs of about packSize.
+type Packer struct {
+	packs [][]*packFile
+	size  int64
+}
+
+// Add queues a file, starting a new pack if the current one is full.
+func (p *Packer) Add(path, relPath string, info os.FileInfo) {
+	if len(p.packs) == 0 || p.size+info.Size() > packSize {
+		p.packs = append(p.packs, nil)
+		p.size = 0
+	}
+
+	last := len(p.packs) - 1
+	p.packs[last] = append(p.packs[last], &packFile{path, relPath, info})
+	p.size += info.Size()
+}
+
+// savePack writes a group of files as a single gzipped tar blob.
+func savePack(files []*packFile, sourceId string, n int) error {
+	file, err := store.Create(sourceId+":pack-"+strconv.Itoa(n), bson.M{"codec": CodecGzip, "pack": true})
+	if err != nil {
+		return err
+	}
+
+	encoder, err := Compress(file, CodecGzip)
+	if err != nil {
+		return abortFile(file, err)
+	}
+
+	id := file.Id()
+	archive := tar.NewWriter(encoder)
+	outputs := make([]Output, 0, len(files))
+	for _, f := range files {
+		out, err := addToPack(archive, f)
+		if err != nil {
+			return abortFile(file, err)
+		}
+		out.Pack = id
+		outputs = append(outputs, out)
+	}
+
+	if err = archive.Close(); err != nil {
+		return abortFile(file, err)
+	}
+	if err = encoder.Close(); err != nil {
+		return abortFile(file, err)
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+
+	resultMutex.Lock()
+	resultFileIds = append(resultFileIds, id)
+	resultPacks = append(resultPacks, Pack{Id: id, Codec: CodecGzip, Count: len(files)})
+	resultOutputs = append(resultOutputs, outputs...)
+	resultMutex.Unlock()
+	saveWg.Done()
+	return nil
+}
+
+// addToPack writes a single file to the tar stream.
+func addToPack(archive *tar.Writer, f *packFile) (Output, error) {
+	content, size, rewritten, err := openOutput(f.path, f.relPath)
+	if err != nil {
+		return Output{}, err
+	}
+	defer content.Close()
+
+	header, err := tar.FileInfoHeader(f.info, "")
+	if err != nil {
+		return Output{}, err
+	}
+	header.Name = f.relPath
+	header.Size = size
+	if err = archive.WriteHeader(header); err != nil {
+		return Output{}, err
+	}
+
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(archive, hash), content); err != nil {
+		return Output{}, err
+	}
+
+	return Output{
+		Path:      f.relPath,
+		Digest:    fmt.Sprintf("%x", hash.Sum(nil)),
+		Size:      size,
+		Rewritten: rewritten,
+	}, nil
+}
+
+// writePack restores every file in a pack, reading it sequentially. Files
+// in the pack that aren't in the manifest are refused, and files in the
+// manifest that aren't in the pack fail the restore.
+func (r *Restorer) writePack(pack Pack, outputs map[string]Output) {
+	file, err := store.Open(pack.Id)
+	if err != nil {
+		r.fail("Unable to find cached pack with id ", pack.Id, ". Please contact support@bowery.io.\n"+err.Error())
+		return
+	}
+	defer file.Close()
+
+	decoder, err := Decompress(file, pack.Codec)
+	if err != nil {
+		r.fail("Failed to decode cached pack", pack.Id.Hex()+".", err)
+		return
+	}
+	defer decoder.Close()
+
+	seen := map[string]bool{}
+	archive := tar.NewReader(decoder)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.fail("Failed to read cached pack", pack.Id.Hex()+".", err)
+			return
+		}
+
+		out, ok := outputs[header.Name]
+		if !ok || out.Pack != pack.Id || seen[header.Name] {
+			r.fail("Refusing to restore " + header.Name + ", it isn't in the manifest.")
+			continue
+		}
+		seen[header.Name] = true
+
+		if err = r.restoreFile(header.Name, archive, out); err != nil {
+			r.fail(err)
+			continue
+		}
+		if err = os.Chmod(rootPath(header.Name), header.FileInfo().Mode()); err != nil {
+			r.fail("Failed to set permissions on", header.Name+".", err)
+			continue
+		}
+		progressBar.Increment()
+	}
+
+	for path, out := range outputs {
+		if out.Pack == pack.Id && !seen[path] {
+			r.fail("Unable to restore " + path + ", it's missing from cached pack " + pack.Id.Hex() + ".")
+		}
+	}
+}
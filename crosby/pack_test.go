@@ -0,0 +1,126 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/thebyrd/pb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// useMemoryStore sets the store, config and root for a test, returning a
+// func that restores them.
+func useMemoryStore(t *testing.T) (*memoryStore, string, func()) {
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cwd, _ := os.Getwd()
+	oldStore, oldConfig, oldRoot := store, config, root
+
+	memory := &memoryStore{blobs: map[primitive.ObjectID][]byte{}}
+	store, config, root = memory, &Config{}, dir
+	resultFileIds, resultOutputs, resultPacks, resultErr = nil, nil, nil, nil
+
+	return memory, dir, func() {
+		os.Chdir(cwd)
+		os.RemoveAll(dir)
+		store, config, root = oldStore, oldConfig, oldRoot
+	}
+}
+
+// restoreDir creates an empty directory under dir and makes it the root
+// and current directory.
+func restoreDir(t *testing.T, dir, name string) {
+	path := filepath.Join(dir, name)
+	if err := os.Mkdir(path, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(path); err != nil {
+		t.Fatal(err)
+	}
+	root = path
+}
+
+func TestPackRoundTrip(t *testing.T) {
+	memory, dir, done := useMemoryStore(t)
+	defer done()
+
+	files := map[string]os.FileMode{"a.txt": 0644, "bin/run.sh": 0755}
+	packer := &Packer{}
+	for relPath, mode := range files {
+		path := filepath.Join(dir, relPath)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("contents of "+relPath), mode); err != nil {
+			t.Fatal(err)
+		}
+		info, _ := os.Stat(path)
+		packer.Add(path, relPath, info)
+	}
+
+	if len(packer.packs) != 1 {
+		t.Fatal("expected small files to share a pack, got", len(packer.packs))
+	}
+	saveWg.Add(1)
+	if err := savePack(packer.packs[0], primitive.NewObjectID().Hex(), 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(resultPacks) != 1 || len(memory.blobs) != 1 || len(resultOutputs) != len(files) {
+		t.Fatal("expected a single pack blob, got", resultPacks, len(memory.blobs), resultOutputs)
+	}
+
+	outputs := map[string]Output{}
+	for _, out := range resultOutputs {
+		if out.Pack != resultPacks[0].Id {
+			t.Error("expected", out.Path, "to refer to its pack")
+		}
+		outputs[out.Path] = out
+	}
+
+	restoreDir(t, dir, "restored")
+	progressBar = pb.New(len(files))
+	(&Restorer{}).writePack(resultPacks[0], outputs)
+	for relPath, mode := range files {
+		data, err := ioutil.ReadFile(relPath)
+		if err != nil || string(data) != "contents of "+relPath {
+			t.Error("expected", relPath, "to be restored, got", string(data), err)
+			continue
+		}
+		if info, _ := os.Stat(relPath); info.Mode().Perm() != mode {
+			t.Error("expected", relPath, "to have mode", mode, "got", info.Mode().Perm())
+		}
+	}
+
+	out := outputs["a.txt"]
+	out.Digest = "bad"
+	outputs["a.txt"] = out
+	restoreDir(t, dir, "tampered")
+	(&Restorer{}).writePack(resultPacks[0], outputs)
+	if _, err := os.Stat("a.txt"); !os.IsNotExist(err) {
+		t.Error("expected a file with a bad digest to be removed")
+	}
+	if _, err := os.Stat("bin/run.sh"); err != nil {
+		t.Error("expected the rest of the pack to be restored,", err)
+	}
+
+	// Files missing from the pack fail, and those missing from the
+	// manifest aren't restored.
+	outputs = map[string]Output{"missing.txt": {Path: "missing.txt", Pack: resultPacks[0].Id}}
+	for _, out := range resultOutputs {
+		if out.Path == "a.txt" {
+			outputs[out.Path] = out
+		}
+	}
+	restoreDir(t, dir, "mismatched")
+	r := &Restorer{}
+	r.writePack(resultPacks[0], outputs)
+	if err := r.Err(); err == nil || atomic.LoadInt64(&r.failed) != 2 {
+		t.Error("expected the missing and unlisted files to fail, got", r.failed, err)
+	}
+	if _, err := os.Stat("bin/run.sh"); !os.IsNotExist(err) {
+		t.Error("expected a file that isn't in the manifest not to be restored")
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the platform descriptor of the host, which is part of the
+// cache key.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// DefaultPlatform are the platform components in the key if the config
+// doesn't set any.
+var DefaultPlatform = []string{"os", "arch", "libc"}
+
+// platformDetectors detect each component of the platform, an empty value
+// means it isn't known on this host.
+var platformDetectors = map[string]func() string{
+	"os":     func() string { return runtime.GOOS },
+	"arch":   hostMachine,
+	"kernel": func() string { return command("uname", "-r") },
+	"libc":   libc,
+	"cpu":    cpuFeatures,
+	"distro": distro,
+}
+
+// machines maps uname machine names to Go's arch names.
+var machines = map[string]string{
+	"x86_64":  "amd64",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"armv7l":  "arm",
+}
+
+// command runs a command and returns its trimmed output, empty if it
+// fails.
+func command(name string, args ...string) string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(out))
+}
+
+// hostMachine returns the arch of the host, which can differ from the
+// arch crosby was built for.
+func hostMachine() string {
+	if runtime.GOOS == "windows" {
+		return runtime.GOARCH
+	}
+
+	machine := command("uname", "-m")
+	if arch, ok := machines[machine]; ok {
+		return arch
+	}
+	if machine == "" {
+		return runtime.GOARCH
+	}
+	return machine
+}
+
+// HostArch returns the os and arch of the host, like linux-amd64.
+func HostArch() string {
+	return runtime.GOOS + "-" + hostMachine()
+}
+
+// Matches the version at the end of ldd's first line, or musl's version
+// line.
+var libcVersion = regexp.MustCompile(`(?m)(?:\) |^Version )([0-9][0-9.]*)\s*$`)
+
+// parseLdd returns the libc flavour and version from ldd --version.
+func parseLdd(out string) string {
+	flavour := "glibc"
+	if strings.Contains(out, "musl") {
+		flavour = "musl"
+	} else if !strings.Contains(strings.ToLower(out), "glibc") && !strings.Contains(out, "GNU libc") {
+		return ""
+	}
+
+	match := libcVersion.FindStringSubmatch(out)
+	if match == nil {
+		return flavour
+	}
+	return flavour + "-" + match[1]
+}
+
+// libc returns the libc flavour and version, only on linux.
+func libc() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+
+	// musl's ldd prints its version to stderr and exits non-zero.
+	out, _ := exec.Command("ldd", "--version").CombinedOutput()
+	return parseLdd(string(out))
+}
+
+// cpuFeatures returns the sorted features of the cpu.
+func cpuFeatures() string {
+	var features []string
+	switch runtime.GOOS {
+	case "linux":
+		data, err := ioutil.ReadFile("/proc/cpuinfo")
+		if err != nil {
+			return ""
+		}
+		features = parseCPUInfo(data)
+	case "darwin":
+		features = strings.Fields(strings.ToLower(command("sysctl", "-n", "machdep.cpu.features")))
+	}
+
+	sort.Strings(features)
+	return strings.Join(features, " ")
+}
+
+// parseCPUInfo returns the features of the first cpu in /proc/cpuinfo.
+func parseCPUInfo(data []byte) []string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		// flags on x86, Features on arm.
+		name := strings.TrimSpace(parts[0])
+		if name == "flags" || name == "Features" {
+			return strings.Fields(parts[1])
+		}
+	}
+
+	return nil
+}
+
+// parseOSRelease returns the id and version from /etc/os-release, like
+// ubuntu-14.04.
+func parseOSRelease(data []byte) string {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) == 2 {
+			values[parts[0]] = strings.Trim(parts[1], `"'`)
+		}
+	}
+
+	if values["ID"] == "" || values["VERSION_ID"] == "" {
+		return values["ID"]
+	}
+	return values["ID"] + "-" + values["VERSION_ID"]
+}
+
+// distro returns the distribution and its version.
+func distro() string {
+	switch runtime.GOOS {
+	case "linux":
+		data, err := ioutil.ReadFile("/etc/os-release")
+		if err != nil {
+			return ""
+		}
+		return parseOSRelease(data)
+	case "darwin":
+		if version := command("sw_vers", "-productVersion"); version != "" {
+			return "macos-" + version
+		}
+	}
+
+	return ""
+}
+
+// Platform returns the platform components that are part of the key, set
+// by platform in the config.
+func Platform() (map[string]string, error) {
+	components := config.Platform
+	if len(components) == 0 {
+		components = DefaultPlatform
+	}
+
+	platform := map[string]string{}
+	for _, name := range components {
+		detect, ok := platformDetectors[name]
+		if !ok {
+			return nil, errors.New("Unknown platform component " + name + ", must be one of os, arch, kernel, libc, cpu or distro.")
+		}
+
+		if value := detect(); value != "" {
+			platform[name] = value
+		}
+	}
+
+	return platform, nil
+}
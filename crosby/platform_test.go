@@ -0,0 +1,35 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLdd(t *testing.T) {
+	cases := map[string]string{
+		"ldd (Ubuntu GLIBC 2.19-0ubuntu6) 2.19\nCopyright (C) 2014 Free Software Foundation, Inc.\n": "glibc-2.19",
+		"ldd (GNU libc) 2.17\n": "glibc-2.17",
+		"musl libc (x86_64)\nVersion 1.1.5\nDynamic Program Loader\n": "musl-1.1.5",
+		"ldd: command not found": "",
+	}
+
+	for out, expected := range cases {
+		if libc := parseLdd(out); libc != expected {
+			t.Errorf("expected %q got %q", expected, libc)
+		}
+	}
+}
+
+func TestParseOSRelease(t *testing.T) {
+	data := []byte("NAME=\"Ubuntu\"\nVERSION=\"14.04, Trusty Tahr\"\nID=ubuntu\nVERSION_ID=\"14.04\"\n")
+	if distro := parseOSRelease(data); distro != "ubuntu-14.04" {
+		t.Error("unexpected distro", distro)
+	}
+}
+
+func TestParseCPUInfo(t *testing.T) {
+	data := []byte("processor\t: 0\nflags\t\t: fpu sse2 avx2\n\nprocessor\t: 1\nflags\t\t: fpu\n")
+	if features := parseCPUInfo(data); !reflect.DeepEqual(features, []string{"fpu", "sse2", "avx2"}) {
+		t.Error("unexpected features", features)
+	}
+}
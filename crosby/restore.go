@@ -0,0 +1,332 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the restore engine that writes cached results into the tree.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thebyrd/pb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Restorer writes the blobs of a source to disk, with at most Parallelism
+// blobs open at once.
+type Restorer struct {
+	Parallelism int
+	bytes       int64
+	files       int64
+	failed      int64
+	start       time.Time
+}
+
+// NewRestorer creates a restorer using the parallelism from the env or
+// config, defaulting to a few workers per CPU.
+func NewRestorer() *Restorer {
+	parallelism := config.Parallelism
+	if env, err := strconv.Atoi(os.Getenv("CROSBY_PARALLELISM")); err == nil {
+		parallelism = env
+	}
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU() * 4
+	}
+
+	return &Restorer{Parallelism: parallelism}
+}
+
+// Run calls each job from a pool of workers and waits for them to finish.
+func (r *Restorer) Run(jobs []func()) {
+	queue := make(chan func())
+	var wg sync.WaitGroup
+
+	for i := 0; i < r.Parallelism && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// Report prints the throughput of the restore.
+func (r *Restorer) Report() {
+	elapsed := time.Since(r.start).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	fmt.Printf("Restored %d files (%.1f MB) in %.1fs, %.1f MB/s, %.0f files/s\n",
+		r.files, float64(r.bytes)/(1<<20), elapsed,
+		float64(r.bytes)/(1<<20)/elapsed, float64(r.files)/elapsed)
+}
+
+// WriteFromCache restores every blob of the source. Packs are read
+// sequentially by a single worker each. An error is returned if any file
+// couldn't be restored.
+func (r *Restorer) WriteFromCache(s *Source) error {
+	r.start = time.Now()
+	if len(s.Outputs) == 0 {
+		r.writeLegacy(s)
+		return r.Err()
+	}
+	fmt.Println("Writing Files from Crosby ...")
+	progressBar = pb.StartNew(len(s.Outputs))
+
+	jobs := make([]func(), 0, len(s.Outputs))
+	packed := map[string]Output{}
+	for _, out := range s.Outputs {
+		out := out
+		if !safePath(out.Path) {
+			r.fail("Refusing to restore " + out.Path + " outside of the root.")
+			continue
+		}
+
+		switch {
+		case !out.Pack.IsZero():
+			packed[out.Path] = out
+		case len(out.Parts) > 0:
+			jobs = append(jobs, func() { r.writeChunked(out) })
+		default:
+			jobs = append(jobs, func() { r.writeFile(out.Id, out.Path, out) })
+		}
+	}
+
+	for _, pack := range s.Packs {
+		pack := pack
+		jobs = append(jobs, func() { r.writePack(pack, packed) })
+	}
+	r.Run(jobs)
+	return r.Err()
+}
+
+// fail prints why a file couldn't be restored and counts it.
+func (r *Restorer) fail(a ...interface{}) {
+	fmt.Println(a...)
+	atomic.AddInt64(&r.failed, 1)
+}
+
+// Err returns an error if any file couldn't be restored.
+func (r *Restorer) Err() error {
+	if failed := atomic.LoadInt64(&r.failed); failed > 0 {
+		return errors.New(strconv.FormatInt(failed, 10) + " files couldn't be restored.")
+	}
+
+	return nil
+}
+
+// writeLegacy restores a source cached before outputs were recorded, the
+// paths come from the GridFS file names.
+func (r *Restorer) writeLegacy(s *Source) {
+	resultId := s.Id.Hex()
+	targetResults, err := legacyFiles(s.ResultIds)
+	if err != nil {
+		r.fail("Unable to find cached files with ids", s.ResultIds, ". Please contact support@bowery.io.\n"+err.Error())
+		return
+	}
+	if len(targetResults) < 1 {
+		fmt.Println("This command does not update your current directory. No action was taken.")
+		os.Exit(1)
+	} else {
+		fmt.Println("Writing Files from Crosby ...")
+	}
+	progressBar = pb.StartNew(len(targetResults))
+
+	jobs := make([]func(), 0, len(targetResults))
+	for _, f := range targetResults {
+		id := f.Id
+		outPath := strings.Replace(f.Name, resultId+":", "", -1)
+		jobs = append(jobs, func() { r.writeFile(id, outPath, Output{}) })
+	}
+	r.Run(jobs)
+}
+
+// legacyFile is a GridFS file of a source cached before outputs were
+// recorded.
+type legacyFile struct {
+	Id   primitive.ObjectID `bson:"_id"`
+	Name string             `bson:"filename"`
+}
+
+// legacyFiles returns the GridFS files with the given ids.
+func legacyFiles(ids []primitive.ObjectID) ([]legacyFile, error) {
+	mb, err := requireMongo("restore")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), mongoTimeout)
+	defer cancel()
+	cursor, err := mb.Files.Find(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	if err != nil {
+		return nil, err
+	}
+
+	files := []legacyFile{}
+	err = cursor.All(ctx, &files)
+	return files, err
+}
+
+// writeFile restores a cached file, decoding it with the outputs codec.
+func (r *Restorer) writeFile(id primitive.ObjectID, outPath string, out Output) {
+	file, err := store.Open(id)
+	if err != nil {
+		r.fail("Unable to find cached file with id ", id, ". Please contact support@bowery.io.\n"+err.Error())
+		return
+	}
+
+	decoder, err := Decompress(file, out.Codec)
+	if err != nil {
+		file.Close()
+		r.fail("Failed to decode cached file", outPath+".", err)
+		return
+	}
+
+	err = r.restoreFile(outPath, decoder, out)
+	decoder.Close()
+	if err != nil {
+		file.Close()
+		r.fail(err)
+		return
+	}
+
+	if err = file.Close(); err != nil {
+		r.fail("Failed to close resulting file. Please make sure this program has appropriate permission.\n" + err.Error())
+		return
+	}
+
+	if err = exec.Command("chmod", "+x", rootPath(outPath)).Run(); err != nil {
+		r.fail("Failed to make resulting file executable. Please make sure this program has appropriate permission.\n" + err.Error())
+		return
+	}
+	progressBar.Increment()
+}
+
+// safePath checks a path from a manifest stays inside the root.
+func safePath(path string) bool {
+	return !filepath.IsAbs(path) && !strings.HasPrefix(filepath.Clean(path), "..")
+}
+
+// restoreFile writes the contents of rd to outPath, relative to the
+// root. If the output has a
+// digest the contents must match it, or the existing file is left alone.
+func (r *Restorer) restoreFile(outPath string, rd io.Reader, out Output) error {
+	temp, err := createTemp(outPath)
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	var size int64
+	if out.Rewritten {
+		// The digest is of the contents with the placeholder.
+		var data []byte
+		data, err = ioutil.ReadAll(io.TeeReader(rd, hash))
+		if err == nil {
+			var n int
+			n, err = temp.Write(ExpandPaths(data, root))
+			size = int64(n)
+		}
+	} else {
+		size, err = io.Copy(io.MultiWriter(temp, hash), rd)
+	}
+	if err != nil {
+		discardTemp(temp)
+		return errors.New("Failed to copy file from cache to your computer. Please make sure this program has appropriate permission.\n" + err.Error())
+	}
+
+	if err = r.verify(outPath, fmt.Sprintf("%x", hash.Sum(nil)), out); err != nil {
+		discardTemp(temp)
+		return err
+	}
+	if err = replaceFile(temp, outPath); err != nil {
+		return err
+	}
+	r.record(size)
+	return nil
+}
+
+// createTemp creates a temporary file next to outPath, relative to the
+// root, to restore into so
+// a file that fails to restore never replaces the one already there.
+func createTemp(outPath string) (*os.File, error) {
+	path := rootPath(outPath)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm|os.ModeDir); err != nil {
+		return nil, err
+	}
+
+	temp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".crosby")
+	if err == nil {
+		err = temp.Chmod(0644)
+		if err != nil {
+			discardTemp(temp)
+		}
+	}
+	if err != nil {
+		return nil, errors.New("Failed to create file. Please make sure this program has appropriate permission.\n" + err.Error())
+	}
+
+	return temp, nil
+}
+
+// discardTemp closes and removes a temporary file.
+func discardTemp(temp *os.File) {
+	temp.Close()
+	os.Remove(temp.Name())
+}
+
+// replaceFile closes a restored temporary file and moves it to outPath,
+// relative to the root.
+func replaceFile(temp *os.File, outPath string) error {
+	err := temp.Close()
+	if err == nil {
+		err = os.Rename(temp.Name(), rootPath(outPath))
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return errors.New("Failed to replace " + outPath + ". Please make sure this program has appropriate permission.\n" + err.Error())
+	}
+
+	return nil
+}
+
+// verify compares the sum of a restored file with the outputs digest.
+// Outputs without a digest are only allowed if no keys are trusted.
+func (r *Restorer) verify(outPath, sum string, out Output) error {
+	digest := out.Digest
+	if digest == "" && len(config.TrustedKeys) > 0 {
+		digest = "missing"
+	}
+	if digest != "" && sum != digest {
+		return errors.New("Refusing to restore " + outPath + ". " + ErrDigestMismatch.Error())
+	}
+
+	return nil
+}
+
+// record adds a restored file to the throughput counters.
+func (r *Restorer) record(size int64) {
+	atomic.AddInt64(&r.bytes, size)
+	atomic.AddInt64(&r.files, 1)
+}
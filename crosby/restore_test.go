@@ -0,0 +1,121 @@
+package main
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thebyrd/pb"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRestorerRun(t *testing.T) {
+	r := &Restorer{Parallelism: 2}
+	var mutex sync.Mutex
+	running, max, done := 0, 0, 0
+
+	jobs := make([]func(), 10)
+	for i := range jobs {
+		jobs[i] = func() {
+			mutex.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			mutex.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mutex.Lock()
+			running--
+			done++
+			mutex.Unlock()
+		}
+	}
+	r.Run(jobs)
+
+	if done != len(jobs) {
+		t.Error("expected all jobs to run, ran", done)
+	}
+	if max > r.Parallelism {
+		t.Error("expected at most", r.Parallelism, "jobs at once, got", max)
+	}
+}
+
+func TestWriteFileFailure(t *testing.T) {
+	memory, dir, done := useMemoryStore(t)
+	defer done()
+
+	blob, _ := memory.Create("a", nil)
+	blob.Write([]byte("crosby"))
+	blob.Close()
+	restoreDir(t, dir, "restored")
+	progressBar = pb.New(2)
+
+	if err := ioutil.WriteFile("a.txt", []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	r := &Restorer{}
+	r.writeFile(blob.Id(), "a.txt", Output{Path: "a.txt", Digest: "bad"})
+	if r.Err() == nil {
+		t.Error("expected a file with a bad digest to fail the restore")
+	}
+	if data, err := ioutil.ReadFile("a.txt"); err != nil || string(data) != "original" {
+		t.Error("expected the existing file to survive a rejected restore, got", string(data), err)
+	}
+	if infos, _ := ioutil.ReadDir("."); len(infos) != 1 {
+		t.Error("expected the temporary file to be removed, got", len(infos), "files")
+	}
+	if memory.closes != memory.opens {
+		t.Error("expected every blob opened to be closed, opened", memory.opens, "closed", memory.closes)
+	}
+
+	r = &Restorer{}
+	r.writeFile(blob.Id(), "b.txt", Output{Path: "b.txt"})
+	if err := r.Err(); err != nil {
+		t.Error("expected the file to be restored, got", err)
+	}
+}
+
+func TestFailedRestoreEvicted(t *testing.T) {
+	memory, dir, done := useMemoryStore(t)
+	defer done()
+	oldIndex := index
+	defer func() { index = oldIndex }()
+	restoreDir(t, dir, "restored")
+
+	key := &Source{Namespace: "test", Args: []string{"make"}}
+	broken := *key
+	broken.Id = primitive.NewObjectID()
+	broken.Outputs = []Output{{Path: "a.txt", Id: primitive.NewObjectID()}}
+	memIndex := &memoryIndex{entries: []Source{broken}}
+	index = memIndex
+
+	result, err := Lookup(key)
+	if err != nil || result == nil || result.Id != broken.Id {
+		t.Fatal("expected the broken entry to be found, got", result, err)
+	}
+	if err = NewRestorer().WriteFromCache(result); err == nil {
+		t.Fatal("expected the broken entry to fail to restore")
+	}
+	evictBroken(result)
+
+	blob, _ := memory.Create("a", nil)
+	blob.Write([]byte("crosby"))
+	blob.Close()
+	fixed := *key
+	fixed.Id = primitive.NewObjectID()
+	fixed.Outputs = []Output{{Path: "a.txt", Id: blob.Id()}}
+	index.Insert(&fixed)
+
+	if result, err = Lookup(key); err != nil || result == nil || result.Id != fixed.Id {
+		t.Fatal("expected the next run to hit the new entry, got", result, err)
+	}
+	if err = NewRestorer().WriteFromCache(result); err != nil {
+		t.Error("expected the new entry to restore, got", err)
+	}
+	if len(memIndex.entries) != 1 {
+		t.Error("expected only the new entry to be left, got", len(memIndex.entries))
+	}
+}
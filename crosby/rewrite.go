@@ -0,0 +1,129 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the rewriting of the root path in text outputs, so results
+// that embed it can be restored in a different checkout.
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// rootPlaceholder replaces the root in rewritten outputs.
+const rootPlaceholder = "@CROSBY_ROOT@"
+
+// shouldRewrite checks if an output matches one of the rewritePaths
+// patterns, either by its path or its name.
+func shouldRewrite(relPath string) bool {
+	for _, pattern := range config.RewritePaths {
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(relPath)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RewritePaths replaces the root in text with the placeholder, it returns
+// false if the data is binary or doesn't contain the root. The root is
+// only replaced where it's a whole path, so a sibling like /src2 of /src
+// is left alone. A placeholder already in the text is escaped with a
+// trailing @ so it's restored as is.
+func RewritePaths(data []byte, dir string) ([]byte, bool) {
+	if dir == "" || bytes.IndexByte(data, 0) >= 0 {
+		return data, false
+	}
+
+	placeholder, root := []byte(rootPlaceholder), []byte(dir)
+	var out bytes.Buffer
+	rewritten := false
+	for i := 0; i < len(data); {
+		switch {
+		case bytes.HasPrefix(data[i:], placeholder):
+			out.Write(placeholder)
+			out.WriteByte('@')
+			i += len(placeholder)
+		case bytes.HasPrefix(data[i:], root) && pathBoundary(data, i+len(root)):
+			out.Write(placeholder)
+			rewritten = true
+			i += len(root)
+		default:
+			out.WriteByte(data[i])
+			i++
+		}
+	}
+	if !rewritten {
+		return data, false
+	}
+
+	return out.Bytes(), true
+}
+
+// pathBoundary checks if a path ends at i, the end of the data or a
+// separator, quote or whitespace.
+func pathBoundary(data []byte, i int) bool {
+	if i >= len(data) {
+		return true
+	}
+
+	switch data[i] {
+	case '/', '\\', '"', '\'', ' ', '\t', '\r', '\n':
+		return true
+	}
+	return false
+}
+
+// ExpandPaths replaces the placeholder with the local root, and escaped
+// placeholders with the placeholder.
+func ExpandPaths(data []byte, dir string) []byte {
+	placeholder := []byte(rootPlaceholder)
+	var out bytes.Buffer
+	for {
+		i := bytes.Index(data, placeholder)
+		if i < 0 {
+			out.Write(data)
+			return out.Bytes()
+		}
+
+		out.Write(data[:i])
+		data = data[i+len(placeholder):]
+		if len(data) > 0 && data[0] == '@' {
+			out.Write(placeholder)
+			data = data[1:]
+		} else {
+			out.WriteString(dir)
+		}
+	}
+}
+
+// openOutput opens an output to be saved, rewriting the root if it's
+// configured to. It returns the size of the contents that are saved and
+// if they were rewritten.
+func openOutput(path, relPath string) (io.ReadCloser, int64, bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if !shouldRewrite(relPath) {
+		info, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, false, err
+		}
+		return file, info.Size(), false, nil
+	}
+	defer file.Close()
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	data, rewritten := RewritePaths(data, root)
+
+	return ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)), rewritten, nil
+}
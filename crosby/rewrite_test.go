@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRewritePaths(t *testing.T) {
+	deps := []byte("/home/alice/proj/build/main.o: /home/alice/proj/src/main.c\n")
+	rewritten, ok := RewritePaths(deps, "/home/alice/proj")
+	if !ok || string(rewritten) != "@CROSBY_ROOT@/build/main.o: @CROSBY_ROOT@/src/main.c\n" {
+		t.Fatal("unexpected rewrite", string(rewritten))
+	}
+
+	expanded := ExpandPaths(rewritten, "/home/bob/src/proj")
+	if string(expanded) != "/home/bob/src/proj/build/main.o: /home/bob/src/proj/src/main.c\n" {
+		t.Error("unexpected expansion", string(expanded))
+	}
+
+	binary := []byte("/home/alice/proj\x00")
+	if out, ok := RewritePaths(binary, "/home/alice/proj"); ok || !bytes.Equal(out, binary) {
+		t.Error("expected binary data to be left alone")
+	}
+}
+
+func TestShouldRewrite(t *testing.T) {
+	old := config
+	config = &Config{RewritePaths: []string{"*.d", "lib/pkgconfig/*.pc"}}
+	defer func() { config = old }()
+
+	cases := map[string]bool{
+		"build/main.d":         true,
+		"lib/pkgconfig/foo.pc": true,
+		"share/foo.pc":         false,
+		"main.o":               false,
+	}
+	for path, expected := range cases {
+		if shouldRewrite(path) != expected {
+			t.Error(path, "expected rewrite", expected)
+		}
+	}
+}
+
+func TestRewritePathsBoundary(t *testing.T) {
+	data := []byte(`/home/u/src/a.o: /home/u/src2/b.h "/home/u/src" /home/u/src` + "\n@CROSBY_ROOT@ /home/u/src")
+	rewritten, ok := RewritePaths(data, "/home/u/src")
+	expected := `@CROSBY_ROOT@/a.o: /home/u/src2/b.h "@CROSBY_ROOT@" @CROSBY_ROOT@` + "\n@CROSBY_ROOT@@ @CROSBY_ROOT@"
+	if !ok || string(rewritten) != expected {
+		t.Fatal("expected only whole paths to be rewritten, got", string(rewritten))
+	}
+
+	if expanded := ExpandPaths(rewritten, "/home/u/src"); !bytes.Equal(expanded, data) {
+		t.Error("expected the data to round trip, got", string(expanded))
+	}
+
+	sibling := []byte("/home/u/src2/b.h\n")
+	if out, ok := RewritePaths(sibling, "/home/u/src"); ok || !bytes.Equal(out, sibling) {
+		t.Error("expected a sibling directory to be left alone, got", string(out))
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the cache root, which manifest paths are relative to, and the
+// input subtrees under it.
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// existing are the files outside of the inputs when the key was computed,
+// with their modification times, so they aren't mistaken for outputs.
+var existing = map[string]time.Time{}
+
+// FindRoot returns the cache root set in the config, the git toplevel for
+// "git" or a path relative to the config file. It's the current
+// directory if it isn't set.
+func FindRoot() (string, error) {
+	switch config.Root {
+	case "":
+		return os.Getwd()
+	case "git":
+		out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			return "", errors.New("Unable to find the git toplevel for the cache root, is this a git repo?")
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	dir := config.Root
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(ConfigPath()), dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// PinRoot sets the cache root, outputs are restored relative to it so
+// hits work from any subdirectory. Commands still run in the current
+// directory.
+func PinRoot() error {
+	dir, err := FindRoot()
+	if err != nil {
+		return err
+	}
+
+	root = dir
+	return nil
+}
+
+// RunDir returns the current directory relative to the root, which is
+// part of the key since the command runs there. It's empty at the root.
+func RunDir() string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	base := root
+	if resolved, err := filepath.EvalSymlinks(base); err == nil {
+		base = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(cwd); err == nil {
+		cwd = resolved
+	}
+
+	rel, err := filepath.Rel(base, cwd)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rootPath returns the path of a file relative to the root.
+func rootPath(relPath string) string {
+	return filepath.Join(root, relPath)
+}
+
+// isInput checks if a path relative to the root is in one of the input
+// subtrees, every path is if there are none.
+func isInput(relPath string, inputs []string) bool {
+	if len(inputs) == 0 {
+		return true
+	}
+
+	relPath = filepath.ToSlash(filepath.Clean(relPath))
+	for _, input := range inputs {
+		input = filepath.ToSlash(filepath.Clean(input))
+		if input == "." || relPath == input || strings.HasPrefix(relPath, input+"/") {
+			return true
+		}
+	}
+
+	return false
+}
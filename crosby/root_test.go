@@ -0,0 +1,60 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsInput(t *testing.T) {
+	inputs := []string{"lib", "cmd/server/"}
+	cases := map[string]bool{
+		"lib":               true,
+		"lib/util.c":        true,
+		"library/util.c":    false,
+		"cmd/server/main.c": true,
+		"cmd/client/main.c": false,
+		"Makefile":          false,
+	}
+
+	for path, expected := range cases {
+		if isInput(path, inputs) != expected {
+			t.Error(path, "expected input", expected)
+		}
+	}
+	if !isInput("Makefile", nil) {
+		t.Error("expected every path to be an input without subtrees")
+	}
+}
+
+func TestRunDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crosby")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "sub", "lib"), 0755)
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	oldRoot := root
+	root = dir
+	defer func() { root = oldRoot }()
+
+	os.Chdir(dir)
+	if rel := RunDir(); rel != "" {
+		t.Error("expected no dir at the root, got", rel)
+	}
+	os.Chdir(filepath.Join(dir, "sub", "lib"))
+	if rel := RunDir(); rel != "sub/lib" {
+		t.Error("expected the dir relative to the root, got", rel)
+	}
+
+	// The same command in another directory is a different key.
+	s := &Source{Namespace: "test", Args: []string{"make"}}
+	sub := *s
+	sub.Dir = "sub"
+	if s.KeyDigest() == sub.KeyDigest() {
+		t.Error("expected the dir to be part of the key")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the run command, which wraps a command with the cache.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+const runUsage = `Usage: crosby run [--mode <mode>] [--ttl <duration>] [--dry-run] [--] <command> [args...]`
+
+// RunCommand runs a command, restoring its result from the cache on a hit
+// and caching it on a miss.
+func RunCommand(cmdArgs []string) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&mode, "mode", "", "")
+	flags.DurationVar(&ttl, "ttl", 0, "")
+	flags.BoolVar(&explain, "dry-run", false, "")
+	flags.BoolVar(&explain, "explain", false, "")
+	if err := flags.Parse(cmdArgs); err != nil {
+		return errors.New(err.Error() + "\n" + runUsage)
+	}
+	args = flags.Args()
+
+	if len(args) < 1 {
+		return errors.New("Error: Must Specify Command to Run\n" + runUsage)
+	}
+
+	if explain && mode == "" {
+		mode = ModeReadOnly
+	}
+	var err error
+	mode, err = CacheMode()
+	if err != nil {
+		return err
+	}
+	if mode == ModeDisabled {
+		if explain {
+			fmt.Println("The cache is disabled, the command would run without it.")
+			return nil
+		}
+		os.Exit(RunUncached())
+	}
+	if err := PinRoot(); err != nil {
+		return err
+	}
+
+	// Explaining never runs the command, so errors are reported instead of
+	// degrading to an uncached run.
+	if err := OpenStore(); err != nil {
+		if explain {
+			return errors.New("Unable to reach the cache: " + err.Error())
+		}
+		Degrade(err)
+	}
+	if CanWrite(mode) && PendingUploads() > 0 {
+		StartUploader()
+	}
+
+	if err := ValidateSession(); err != nil {
+		if IsNetworkError(err) && !explain {
+			Degrade(err)
+		}
+		return err
+	}
+
+	s, err = Fingerprint()
+	if err != nil {
+		return errors.New("Failed: " + err.Error())
+	}
+
+	var result *Source
+	if CanRead(mode) {
+		result, err = Lookup(s)
+		if err != nil {
+			if explain {
+				return errors.New("Unable to look up the cache: " + err.Error())
+			}
+			if IsNetworkError(err) {
+				Degrade(err)
+			}
+			fmt.Println("Unable to look up the cache, running the command:", err)
+		}
+	}
+	notFound := err != nil || result == nil
+	// Hits from the shared namespace are read-only.
+	owned := !notFound && result.Namespace == s.Namespace
+	key := s
+	if !notFound {
+		s = result
+	}
+
+	if explain {
+		Explain(s, result)
+		return nil
+	}
+
+	info := map[string]interface{}{
+		"command": args[0],
+		"args":    strings.Join(args[1:], " "), // just the arguments to the command
+		"os":      runtime.GOOS,
+		"arch":    runtime.GOARCH,
+		"mode":    mode,
+	}
+
+	if !notFound {
+		restorer := NewRestorer()
+		if err := restorer.WriteFromCache(s); err != nil {
+			// A partly restored result is a miss, running the command fixes
+			// the tree.
+			progressBar.FinishPrint("Failed!")
+			fmt.Println("Unable to restore the cached result.", err)
+			if CanWrite(mode) && owned {
+				evictBroken(s)
+			}
+			notFound, s = true, key
+		} else {
+			progressBar.FinishPrint("Done!")
+			restorer.Report()
+			if CanWrite(mode) && owned {
+				if err := RecordHit(s, time.Since(restorer.start)); err != nil && err != ErrUnsupported {
+					fmt.Println("Unable to record cache hit:", err)
+				}
+			}
+			info["cacheHit"] = true
+		}
+	}
+
+	if notFound {
+		AddToCache(s)
+		info["cacheHit"] = false
+	}
+
+	info["duration"] = time.Now().Sub(startTime).String()
+	keenC.AddEvent("crosby command", info) // failed commands will have no info regarding duration or cache hit
+	return nil
+}
+
+// evictBroken removes a result that couldn't be restored, so later runs
+// hit the result cached in its place instead of failing again.
+func evictBroken(result *Source) {
+	if err := RemoveEntry(result); err != nil {
+		fmt.Println("Unable to remove the broken cached result "+result.Id.Hex()+":", err)
+	}
+}
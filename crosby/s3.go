@@ -0,0 +1,435 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the backend for S3 compatible buckets, which are read and
+// written with presigned urls.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const presignUsage = `Usage: crosby presign [--listen <addr>]`
+
+// How long presigned urls are valid for.
+const presignExpiry = 15 * time.Minute
+
+// ErrS3NotFound is returned when the bucket doesn't have an object.
+var ErrS3NotFound = errors.New("not found in the bucket")
+
+// Keys the presign server hands out urls for.
+var presignKey = regexp.MustCompile(`^(entries/[0-9a-f]+\.json|blobs/[0-9a-f]+)$`)
+
+// S3Config is the bucket used by the s3 backend.
+type S3Config struct {
+	// Endpoint is the url of the S3 compatible server, defaulting to
+	// https://s3.amazonaws.com. Buckets are addressed by path.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Bucket is the name of the bucket.
+	Bucket string `json:"bucket,omitempty"`
+
+	// Region is the region of the bucket, defaulting to us-east-1.
+	Region string `json:"region,omitempty"`
+
+	// PresignURL is the url of a crosby presign server, which hands out
+	// presigned urls so clients don't need credentials. Without it
+	// credentials are read from AWS_ACCESS_KEY_ID and
+	// AWS_SECRET_ACCESS_KEY.
+	PresignURL string `json:"presignURL,omitempty"`
+}
+
+// Presigner returns presigned urls for objects in the bucket.
+type Presigner interface {
+	Presign(method, key string) (string, error)
+}
+
+// S3Signer presigns urls using AWS signature version 4.
+type S3Signer struct {
+	Endpoint     string
+	Bucket       string
+	Region       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+}
+
+// NewS3Signer creates a signer for the bucket in the config, with
+// credentials from the env.
+func NewS3Signer(cfg *S3Config) (*S3Signer, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("The s3 backend needs s3.bucket set in the config.")
+	}
+
+	signer := &S3Signer{
+		Endpoint:     strings.TrimSuffix(cfg.Endpoint, "/"),
+		Bucket:       cfg.Bucket,
+		Region:       cfg.Region,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if signer.Endpoint == "" {
+		signer.Endpoint = "https://s3.amazonaws.com"
+	}
+	if signer.Region == "" {
+		signer.Region = "us-east-1"
+	}
+	if signer.AccessKey == "" || signer.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set, or s3.presignURL in the config.")
+	}
+
+	return signer, nil
+}
+
+// Presign returns a url for an object that's valid for presignExpiry.
+func (ss *S3Signer) Presign(method, key string) (string, error) {
+	u, err := url.Parse(ss.Endpoint + "/" + ss.Bucket + "/" + key)
+	if err != nil {
+		return "", err
+	}
+
+	return ss.presign(method, u, time.Now(), presignExpiry), nil
+}
+
+// presign adds the query string signing a request to u.
+func (ss *S3Signer) presign(method string, u *url.URL, now time.Time, expires time.Duration) string {
+	now = now.UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + ss.Region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     "AWS4-HMAC-SHA256",
+		"X-Amz-Credential":    ss.AccessKey + "/" + scope,
+		"X-Amz-Date":          now.Format("20060102T150405Z"),
+		"X-Amz-Expires":       strconv.Itoa(int(expires / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	if ss.SessionToken != "" {
+		query["X-Amz-Security-Token"] = ss.SessionToken
+	}
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	params := make([]string, len(keys))
+	for i, key := range keys {
+		params[i] = awsEscape(key, true) + "=" + awsEscape(query[key], true)
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	path := awsEscape(u.Path, false)
+	canonicalRequest := strings.Join([]string{
+		method, path, canonicalQuery, "host:" + u.Host, "", "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", query["X-Amz-Date"], scope, fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+ss.SecretKey), date)
+	key = hmacSHA256(key, ss.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := fmt.Sprintf("%x", hmacSHA256(key, stringToSign))
+
+	return u.Scheme + "://" + u.Host + path + "?" + canonicalQuery + "&X-Amz-Signature=" + signature
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsEscape escapes a string the way AWS signatures expect, slashes are
+// left alone in paths.
+func awsEscape(s string, encodeSlash bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+
+	return buf.String()
+}
+
+// RemotePresigner gets presigned urls from a crosby presign server.
+type RemotePresigner struct {
+	URL    string
+	Token  string
+	Client *http.Client
+}
+
+// Presign asks the server for a url.
+func (rp *RemotePresigner) Presign(method, key string) (string, error) {
+	req, err := http.NewRequest("GET", rp.URL+"?"+url.Values{"method": {method}, "key": {key}}.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	if rp.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+rp.Token)
+	}
+
+	res, err := rp.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errors.New("presign server responded with " + res.Status + ": " + strings.TrimSpace(string(body)))
+	}
+
+	return strings.TrimSpace(string(body)), nil
+}
+
+// S3Cache stores entries and blobs in an S3 compatible bucket. Entries
+// are JSON objects keyed by their key digest, and blobs are keyed by id.
+type S3Cache struct {
+	Presigner Presigner
+	Client    *http.Client
+}
+
+// NewS3Cache creates a cache for the bucket in the config, using the
+// presign server if it's set.
+func NewS3Cache(cfg *S3Config) (*S3Cache, error) {
+	timeout := ConnectTimeout()
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  (&net.Dialer{Timeout: timeout}).Dial,
+		ResponseHeaderTimeout: timeout * 6,
+	}}
+
+	if cfg.PresignURL != "" {
+		presigner := &RemotePresigner{URL: cfg.PresignURL, Token: os.Getenv("CROSBY_PRESIGN_TOKEN"), Client: client}
+		return &S3Cache{presigner, client}, nil
+	}
+
+	signer, err := NewS3Signer(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Cache{signer, client}, nil
+}
+
+// do sends a request for an object, the caller closes the body.
+// ErrS3NotFound is returned for missing objects, including a 403 on a
+// read since S3 hides missing keys without ListBucket.
+func (sc *S3Cache) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	u, err := sc.Presigner.Presign(method, key)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+
+	res, err := sc.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound ||
+		(res.StatusCode == http.StatusForbidden && (method == "GET" || method == "HEAD")) {
+		res.Body.Close()
+		return nil, ErrS3NotFound
+	}
+	if res.StatusCode/100 != 2 {
+		res.Body.Close()
+		return nil, errors.New("s3 responded with " + res.Status + " for " + key)
+	}
+
+	return res, nil
+}
+
+// entryKey returns the key of the entry for a source.
+func entryKey(s *Source) string {
+	return "entries/" + s.KeyDigest() + ".json"
+}
+
+// blobKey returns the key of a blob.
+func blobKey(id primitive.ObjectID) string {
+	return "blobs/" + id.Hex()
+}
+
+// Find reads the entry stored under the source's key digest.
+func (sc *S3Cache) Find(s *Source) ([]Source, error) {
+	res, err := sc.do("GET", entryKey(s), nil, 0)
+	if err == ErrS3NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	entry := Source{}
+	if err = json.NewDecoder(res.Body).Decode(&entry); err != nil {
+		return nil, err
+	}
+	return []Source{entry}, nil
+}
+
+// Insert writes an entry under its key digest.
+func (sc *S3Cache) Insert(s *Source) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	res, err := sc.do("PUT", entryKey(s), bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// RecordHit does nothing, entries aren't rewritten once they're stored.
+func (sc *S3Cache) RecordHit(s *Source, saved time.Duration) error {
+	return nil
+}
+
+// Delete removes the entry for a source.
+func (sc *S3Cache) Delete(s *Source) error {
+	res, err := sc.do("DELETE", entryKey(s), nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Create starts a blob, it's uploaded when it's closed.
+func (sc *S3Cache) Create(name string, meta bson.M) (Blob, error) {
+	return newTempBlob(func(id primitive.ObjectID, body io.Reader, size int64, sum string) error {
+		res, err := sc.do("PUT", blobKey(id), body, size)
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	})
+}
+
+// Open reads a blob.
+func (sc *S3Cache) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	res, err := sc.do("GET", blobKey(id), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Body, nil
+}
+
+// Remove deletes a blob.
+func (sc *S3Cache) Remove(id primitive.ObjectID) error {
+	res, err := sc.do("DELETE", blobKey(id), nil, 0)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// PresignHandler hands out presigned urls for entries and blobs. Requests
+// with readToken as a bearer token only get GET urls, writeToken gets any
+// method. An empty token refuses every request made with it.
+func PresignHandler(signer Presigner, readToken, writeToken string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		canWrite := tokenMatches(req, writeToken)
+		if !canWrite && !tokenMatches(req, readToken) {
+			http.Error(res, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		method := req.FormValue("method")
+		key := req.FormValue("key")
+		if method != "GET" && method != "PUT" && method != "DELETE" {
+			http.Error(res, "invalid method "+method, http.StatusBadRequest)
+			return
+		}
+		if method != "GET" && !canWrite {
+			http.Error(res, "the token can only read", http.StatusForbidden)
+			return
+		}
+		if !presignKey.MatchString(key) {
+			http.Error(res, "invalid key "+key, http.StatusBadRequest)
+			return
+		}
+
+		u, err := signer.Presign(method, key)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(res, u)
+	}
+}
+
+// tokenMatches checks if the request has token as its bearer token.
+func tokenMatches(req *http.Request, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
+
+// PresignCommand runs a presign server, so clients can use the bucket
+// without credentials. CROSBY_PRESIGN_WRITE_TOKEN is the token clients need
+// to write, it won't start without one. CROSBY_PRESIGN_READ_TOKEN is an
+// optional token that can only read.
+func PresignCommand(args []string) error {
+	var listen string
+	flags := flag.NewFlagSet("presign", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&listen, "listen", ":8081", "")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + presignUsage)
+	}
+
+	readToken := os.Getenv("CROSBY_PRESIGN_READ_TOKEN")
+	writeToken := os.Getenv("CROSBY_PRESIGN_WRITE_TOKEN")
+	if writeToken == "" {
+		return errors.New("CROSBY_PRESIGN_WRITE_TOKEN must be set, it's the token clients need to write to the bucket.")
+	}
+	if readToken == writeToken {
+		return errors.New("CROSBY_PRESIGN_READ_TOKEN must differ from CROSBY_PRESIGN_WRITE_TOKEN.")
+	}
+
+	cfg := config.S3
+	if cfg == nil {
+		cfg = &S3Config{}
+	}
+	signer, err := NewS3Signer(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Presigning urls for", signer.Bucket, "on", listen)
+	http.Handle("/presign", PresignHandler(signer, readToken, writeToken))
+	return http.ListenAndServe(listen, nil)
+}
@@ -0,0 +1,137 @@
+// Copyright 2014 Bowery, Inc.
+// Contains routines to sign and verify cache entries.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnsigned       = errors.New("cache entry is not signed")
+	ErrUntrustedKey   = errors.New("cache entry is signed by an untrusted key")
+	ErrBadSignature   = errors.New("cache entry signature is invalid")
+	ErrDigestMismatch = errors.New("cached file does not match its signed digest")
+)
+
+// KeyId returns a short identifier for a public key.
+func KeyId(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey creates a new key pair, writing the private key to path.
+func GenerateKey(path string) (ed25519.PublicKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	seed := base64.StdEncoding.EncodeToString(priv.Seed())
+	return pub, ioutil.WriteFile(path, []byte(seed+"\n"), 0600)
+}
+
+// ReadPrivateKey reads a private key written by GenerateKey.
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("invalid signing key in " + path)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ParsePublicKey decodes a base64 encoded public key.
+func ParsePublicKey(key string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key " + key)
+	}
+
+	return ed25519.PublicKey(data), nil
+}
+
+// manifest returns the bytes that are signed for a source, it covers
+// the key the entry was stored under and the digest of every output.
+func manifest(s *Source) []byte {
+	var buf bytes.Buffer
+	if s.Namespace != "" {
+		fmt.Fprintf(&buf, "namespace %s\n", s.Namespace)
+	}
+	fmt.Fprintf(&buf, "arch %s\nargs %q\n", s.Arch, s.Args)
+
+	files := make([]string, 0, len(s.Files))
+	for key, digest := range s.Files {
+		files = append(files, "file "+key+" "+digest)
+	}
+	for key, value := range s.Platform {
+		files = append(files, "platform "+key+" "+value)
+	}
+	for key, value := range s.Env {
+		files = append(files, "env "+key+" "+value)
+	}
+	for key, digest := range s.Toolchain {
+		files = append(files, "tool "+key+" "+digest)
+	}
+	sort.Strings(files)
+
+	outputs := make([]string, 0, len(s.Outputs))
+	for _, out := range s.Outputs {
+		line := "output " + out.Path + " " + out.Digest
+		if out.Rewritten {
+			line += " rewritten"
+		}
+		outputs = append(outputs, line)
+	}
+	sort.Strings(outputs)
+
+	for _, line := range append(files, outputs...) {
+		buf.WriteString(line + "\n")
+	}
+
+	return buf.Bytes()
+}
+
+// SignSource signs the manifest of a source with the given key.
+func SignSource(s *Source, priv ed25519.PrivateKey) {
+	s.KeyId = KeyId(priv.Public().(ed25519.PublicKey))
+	s.Signature = ed25519.Sign(priv, manifest(s))
+}
+
+// VerifySource checks the source is signed by one of the trusted keys.
+func VerifySource(s *Source, keys []*TrustedKey) error {
+	if len(s.Signature) == 0 {
+		return ErrUnsigned
+	}
+
+	for _, trusted := range keys {
+		pub, err := ParsePublicKey(trusted.Key)
+		if err != nil {
+			return err
+		}
+		if KeyId(pub) != s.KeyId {
+			continue
+		}
+
+		if !ed25519.Verify(pub, manifest(s), s.Signature) {
+			return ErrBadSignature
+		}
+		return nil
+	}
+
+	return ErrUntrustedKey
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"testing"
+)
+
+func TestVerifySource(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []*TrustedKey{{Name: "ci", Key: base64.StdEncoding.EncodeToString(pub)}}
+
+	s := &Source{
+		Arch:    "linux-amd64",
+		Args:    []string{"make"},
+		Files:   map[string]string{"main_c": "abc"},
+		Outputs: []Output{{Path: "main", Digest: "def"}},
+	}
+	if err := VerifySource(s, keys); err != ErrUnsigned {
+		t.Fatal("expected unsigned error, got", err)
+	}
+
+	SignSource(s, priv)
+	if err := VerifySource(s, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Outputs[0].Digest = "tampered"
+	if err := VerifySource(s, keys); err != ErrBadSignature {
+		t.Fatal("expected bad signature error, got", err)
+	}
+
+	if err := VerifySource(s, nil); err != ErrUntrustedKey {
+		t.Fatal("expected untrusted key error, got", err)
+	}
+}
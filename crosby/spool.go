@@ -0,0 +1,303 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the spool results are queued in to be uploaded in the
+// background.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// A lock older than this is left from an uploader that died, a running
+// uploader touches it every spoolLockRefresh.
+const spoolLockAge = time.Hour
+
+var spoolLockRefresh = 10 * time.Minute
+
+// SpoolEntry is a result waiting to be uploaded. Its outputs are copied
+// into the files directory next to it. The spool is shared by every
+// project, so the config, root, namespace and mode it was cached with are
+// kept to upload it to the same place.
+type SpoolEntry struct {
+	Source    *Source   `json:"source"`
+	Paths     []string  `json:"paths"`
+	Size      int64     `json:"size"`
+	Created   time.Time `json:"created"`
+	Config    string    `json:"config"`
+	Root      string    `json:"root"`
+	Namespace string    `json:"namespace"`
+	Mode      string    `json:"mode"`
+}
+
+// SpoolDir returns the directory results are spooled in.
+func SpoolDir() string {
+	return filepath.Join(os.Getenv(homeVar), ".crosby", "spool")
+}
+
+// BackgroundUpload checks if results should be spooled instead of
+// uploaded before crosby exits.
+func BackgroundUpload() bool {
+	if env := os.Getenv("CROSBY_BACKGROUND"); env != "" {
+		background, _ := strconv.ParseBool(env)
+		return background
+	}
+
+	return config.BackgroundUpload
+}
+
+// Spool copies the outputs of a source into the spool.
+func Spool(s *Source, relPaths []string) error {
+	dir := filepath.Join(SpoolDir(), s.Id.Hex())
+	entry := &SpoolEntry{
+		Source:    s,
+		Paths:     relPaths,
+		Created:   time.Now(),
+		Config:    ConfigPath(),
+		Root:      root,
+		Namespace: s.Namespace,
+		Mode:      mode,
+	}
+
+	for _, relPath := range relPaths {
+		size, err := copyFile(filepath.Join(root, relPath), filepath.Join(dir, "files", relPath))
+		if err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		entry.Size += size
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+
+	// The entry is written last so a partial spool is never uploaded.
+	return ioutil.WriteFile(filepath.Join(dir, "entry.json"), data, 0644)
+}
+
+// copyFile copies a file keeping its permissions.
+func copyFile(src, dest string) (int64, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return 0, err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err = os.MkdirAll(filepath.Dir(dest), os.ModePerm|os.ModeDir); err != nil {
+		return 0, err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	return io.Copy(out, in)
+}
+
+// SpooledEntries returns the entries waiting to be uploaded, with their
+// directories.
+func SpooledEntries() (map[string]*SpoolEntry, error) {
+	infos, err := ioutil.ReadDir(SpoolDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := map[string]*SpoolEntry{}
+	for _, info := range infos {
+		dir := filepath.Join(SpoolDir(), info.Name())
+		data, err := ioutil.ReadFile(filepath.Join(dir, "entry.json"))
+		if err != nil {
+			continue
+		}
+
+		entry := &SpoolEntry{}
+		if err := json.Unmarshal(data, entry); err != nil {
+			continue
+		}
+		entries[dir] = entry
+	}
+
+	return entries, nil
+}
+
+// PendingUploads returns the number of spooled results.
+func PendingUploads() int {
+	entries, _ := SpooledEntries()
+	return len(entries)
+}
+
+// uploaderRunning checks if an uploader holds the spool lock.
+func uploaderRunning() bool {
+	info, err := os.Stat(filepath.Join(SpoolDir(), "lock"))
+	return err == nil && time.Since(info.ModTime()) < spoolLockAge
+}
+
+// StartUploader starts a detached crosby that drains the spool, unless
+// one is already running.
+func StartUploader() {
+	if uploaderRunning() {
+		return
+	}
+	if err := os.MkdirAll(SpoolDir(), os.ModePerm|os.ModeDir); err != nil {
+		return
+	}
+
+	log, err := os.OpenFile(filepath.Join(SpoolDir(), "upload.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer log.Close()
+
+	executable, err := os.Executable()
+	if err != nil {
+		fmt.Println("Unable to start background upload:", err)
+		return
+	}
+	cmd := exec.Command(executable, "upload")
+	cmd.Dir = root
+	cmd.Stdout = log
+	cmd.Stderr = log
+	detach(cmd)
+	if err := cmd.Start(); err != nil {
+		fmt.Println("Unable to start background upload:", err)
+		return
+	}
+	cmd.Process.Release()
+}
+
+// lockSpool takes the spool lock, removing stale locks. The lock is
+// touched until it's released so a long upload isn't mistaken for a dead
+// one.
+func lockSpool() (func(), error) {
+	path := filepath.Join(SpoolDir(), "lock")
+	if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) >= spoolLockAge {
+		os.Remove(path)
+	}
+
+	lock, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, errors.New("Another upload is already running.")
+	}
+	fmt.Fprintln(lock, os.Getpid())
+	lock.Close()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(spoolLockRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				os.Chtimes(path, now, now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		os.Remove(path)
+	}, nil
+}
+
+// DrainSpool uploads every spooled result, removing them once they're
+// in the cache. Each is uploaded with the config and root it was cached
+// with. Results that fail are left for the next uploader.
+func DrainSpool() {
+	unlock, err := lockSpool()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer unlock()
+
+	entries, err := SpooledEntries()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	var current *SpoolEntry
+	for dir, entry := range entries {
+		fmt.Println(time.Now().Format(time.RFC3339), "Uploading", entry.Source.Id.Hex(),
+			entry.Source.Command, "to", entry.Namespace)
+		if current == nil || !sameProject(current, entry) {
+			current = nil
+			if err := openSpoolEntry(entry); err != nil {
+				fmt.Println(err)
+				continue
+			}
+			current = entry
+		}
+		if err := UploadResult(entry.Source, filepath.Join(dir, "files"), entry.Paths); err != nil {
+			fmt.Println(err)
+			continue
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+// sameProject checks if two spooled results are uploaded the same way.
+func sameProject(a, b *SpoolEntry) bool {
+	return a.Config == b.Config && a.Root == b.Root && a.Mode == b.Mode
+}
+
+// openSpoolEntry switches to the config, root and mode a result was
+// cached with and opens its store.
+func openSpoolEntry(entry *SpoolEntry) error {
+	if entry.Config == "" || entry.Root == "" {
+		return errors.New("Unable to upload " + entry.Source.Id.Hex() + ", it doesn't say where it was cached from.")
+	}
+
+	cfg, err := LoadConfigAt(entry.Config)
+	if err != nil {
+		return err
+	}
+	CloseStore()
+	store, index = nil, nil
+	config, root, mode = cfg, entry.Root, entry.Mode
+	return OpenStore()
+}
+
+// StatusCommand prints the results waiting to be uploaded.
+func StatusCommand() error {
+	entries, err := SpooledEntries()
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		fmt.Println("No pending uploads.")
+		return nil
+	}
+
+	fmt.Println(len(entries), "pending uploads:")
+	for _, entry := range entries {
+		fmt.Printf("  %s  %-30s %5d files %8.1f MB  queued %s ago\n",
+			entry.Source.Id.Hex(), entry.Source.Command, len(entry.Paths),
+			float64(entry.Size)/(1<<20), time.Since(entry.Created)/time.Second*time.Second)
+	}
+	if uploaderRunning() {
+		fmt.Println("An upload is in progress.")
+	}
+
+	return nil
+}
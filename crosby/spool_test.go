@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSpoolRecordsProject(t *testing.T) {
+	home, err := ioutil.TempDir("", "crosby-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+	project := filepath.Join(home, "src", "app")
+	os.MkdirAll(project, 0755)
+	ioutil.WriteFile(filepath.Join(project, ".crosby.json"), []byte(`{}`), 0644)
+	ioutil.WriteFile(filepath.Join(project, "out.txt"), []byte("crosby"), 0644)
+
+	oldRoot, oldHome, oldMode := root, homeVar, mode
+	root, homeVar, mode = project, "CROSBY_TEST_HOME", ModeWriteOnly
+	defer func() { root, homeVar, mode = oldRoot, oldHome, oldMode }()
+	os.Setenv("CROSBY_TEST_HOME", home)
+	defer os.Unsetenv("CROSBY_TEST_HOME")
+
+	s := &Source{Id: primitive.NewObjectID(), Namespace: "github.com/bowery/app"}
+	if err := Spool(s, []string{"out.txt"}); err != nil {
+		t.Fatal(err)
+	}
+	root = home
+
+	entries, err := SpooledEntries()
+	if err != nil || len(entries) != 1 {
+		t.Fatal("expected a spooled entry, got", entries, err)
+	}
+	for _, entry := range entries {
+		if entry.Config != filepath.Join(project, ".crosby.json") || entry.Root != project ||
+			entry.Namespace != s.Namespace || entry.Mode != ModeWriteOnly {
+			t.Error("expected the entry to record where it was cached from, got", entry)
+		}
+	}
+}
+
+func TestLockSpoolRefresh(t *testing.T) {
+	home, err := ioutil.TempDir("", "crosby-home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(home)
+
+	oldHome, oldRefresh := homeVar, spoolLockRefresh
+	homeVar, spoolLockRefresh = "CROSBY_TEST_HOME", time.Millisecond
+	defer func() { homeVar, spoolLockRefresh = oldHome, oldRefresh }()
+	os.Setenv("CROSBY_TEST_HOME", home)
+	defer os.Unsetenv("CROSBY_TEST_HOME")
+	os.MkdirAll(SpoolDir(), 0755)
+
+	unlock, err := lockSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(SpoolDir(), "lock")
+	old := time.Now().Add(-2 * spoolLockAge)
+	os.Chtimes(path, old, old)
+	time.Sleep(20 * time.Millisecond)
+
+	if !uploaderRunning() {
+		t.Error("expected the lock to be touched while it's held")
+	}
+	if _, err := lockSpool(); err == nil {
+		t.Error("expected a second uploader not to take the lock")
+	}
+	unlock()
+	if uploaderRunning() {
+		t.Error("expected the lock to be released")
+	}
+}
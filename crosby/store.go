@@ -0,0 +1,207 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the interface blobs are stored through.
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+)
+
+// Store is a place blobs can be written to and read from. Blobs are
+// immutable once closed so they can be cached by id.
+type Store interface {
+	// Create starts writing a new blob.
+	Create(name string, meta bson.M) (Blob, error)
+
+	// Open reads a blob by id.
+	Open(id primitive.ObjectID) (io.ReadCloser, error)
+
+	// Remove deletes a blob by id.
+	Remove(id primitive.ObjectID) error
+}
+
+// Blob is a blob being written. It's only stored once Close succeeds,
+// Abort discards anything written.
+type Blob interface {
+	io.Writer
+	Id() primitive.ObjectID
+	Abort()
+	Close() error
+}
+
+// tempBlob is a blob written to a temp file, for stores that need the
+// size or digest of a blob before it's uploaded.
+type tempBlob struct {
+	io.Writer
+	id      primitive.ObjectID
+	file    *os.File
+	sum     hash.Hash
+	aborted bool
+	upload  func(id primitive.ObjectID, body io.Reader, size int64, sum string) error
+}
+
+// newTempBlob creates a blob that's passed to upload with its size and
+// sha256 when it's closed.
+func newTempBlob(upload func(id primitive.ObjectID, body io.Reader, size int64, sum string) error) (*tempBlob, error) {
+	file, err := ioutil.TempFile("", "crosby-blob")
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.New()
+	return &tempBlob{
+		Writer: io.MultiWriter(file, sum),
+		id:     primitive.NewObjectID(),
+		file:   file,
+		sum:    sum,
+		upload: upload,
+	}, nil
+}
+
+// Id returns the id of the blob.
+func (b *tempBlob) Id() primitive.ObjectID {
+	return b.id
+}
+
+// Abort discards the blob.
+func (b *tempBlob) Abort() {
+	b.aborted = true
+}
+
+// Close uploads the blob and removes the temp file.
+func (b *tempBlob) Close() error {
+	defer os.Remove(b.file.Name())
+	defer b.file.Close()
+	if b.aborted {
+		return nil
+	}
+
+	size, err := b.file.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	if _, err = b.file.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	return b.upload(b.id, b.file, size, fmt.Sprintf("%x", b.sum.Sum(nil)))
+}
+
+// ErrUnsupported is returned by backends that can't do an operation.
+var ErrUnsupported = errors.New("unsupported by this backend")
+
+// IsNotFound checks if an error is from a blob that doesn't exist, in any
+// backend.
+func IsNotFound(err error) bool {
+	return err == gridfs.ErrFileNotFound || err == ErrS3NotFound ||
+		err == ErrBazelNotFound || os.IsNotExist(err)
+}
+
+// abortFile discards a partially written blob and returns err.
+func abortFile(blob Blob, err error) error {
+	blob.Abort()
+	blob.Close()
+	return err
+}
+
+// removeBlobs removes blobs uploaded for a result that wasn't cached, so
+// they aren't left for gc to find.
+func removeBlobs(ids []primitive.ObjectID) {
+	for _, id := range ids {
+		if err := store.Remove(id); err != nil && !IsNotFound(err) {
+			fmt.Println("Unable to remove uploaded file "+id.Hex()+":", err)
+		}
+	}
+}
+
+// Backends entries and blobs can be stored in.
+const (
+	BackendMongo = "mongo" // Mongo and GridFS, the default.
+	BackendBazel = "bazel" // A Bazel HTTP remote cache.
+	BackendS3    = "s3"    // An S3 compatible bucket.
+)
+
+// OpenStore sets up the index and blob store for the backend, with the
+// local cache in front of the store and the cache mode applied.
+func OpenStore() error {
+	httpClient.Timeout = ConnectTimeout() * 2
+
+	switch config.Backend {
+	case "", BackendMongo:
+		mb, err := ConnectMongo(config.Mongo, ConnectTimeout())
+		if err != nil {
+			return err
+		}
+		store = mb
+		index = mb
+	case BackendBazel:
+		if config.BazelURL == "" {
+			return errors.New("The bazel backend needs bazelURL set to the remote cache.")
+		}
+		bazel := NewBazelCache(config.BazelURL)
+		store = bazel
+		index = bazel
+	case BackendS3:
+		if config.S3 == nil {
+			return errors.New("The s3 backend needs s3 set in the config.")
+		}
+		bucket, err := NewS3Cache(config.S3)
+		if err != nil {
+			return err
+		}
+		store = bucket
+		index = bucket
+	default:
+		return errors.New("Unknown backend " + config.Backend + ", must be mongo, bazel or s3.")
+	}
+
+	if config.Index != nil {
+		primary, ok := index.(entryFinder)
+		if !ok {
+			fmt.Println("The index is only used with the mongo backend, the " + config.Backend +
+				" backend already looks up entries by key.")
+		} else if kv, err := NewKeyValue(config.Index); err != nil {
+			fmt.Println("Unable to use the index at "+config.Index.Addr+":", err)
+		} else {
+			index = &KVIndex{primary, kv}
+		}
+	}
+
+	if config.LocalCache != "off" {
+		dir := config.LocalCache
+		if dir == "" {
+			dir = filepath.Join(os.Getenv(homeVar), ".crosby", "cache")
+		}
+
+		if local, err := NewLocalCache(dir, config.LocalCacheSize<<20, store); err != nil {
+			fmt.Println("Unable to use local cache "+dir+":", err)
+		} else {
+			store = local
+		}
+	}
+
+	store = &ModeStore{mode, store}
+	return nil
+}
+
+// CloseStore closes the connection held by the backend, if it has one.
+func CloseStore() {
+	primary := index
+	if ki, ok := primary.(*KVIndex); ok {
+		primary = ki.Primary
+	}
+
+	if closer, ok := primary.(io.Closer); ok {
+		closer.Close()
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright 2014 Bowery, Inc.
+// Contains chunked transfers for large outputs, so a dropped connection
+// only retries the chunk that failed.
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/cenkalti/backoff"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Files at least this large are transferred in parts.
+var chunkThreshold int64 = 64 << 20
+
+// Size of each part before it's encoded.
+var partSize int64 = 16 << 20
+
+// Part is a piece of a large output stored as its own blob. Each part is
+// encoded on its own with the outputs codec.
+type Part struct {
+	Id     primitive.ObjectID `bson:"id"`
+	Offset int64              `bson:"offset"`
+	Size   int64              `bson:"size"`
+}
+
+// failUpload records that an output couldn't be uploaded, so the result
+// isn't cached without it.
+func failUpload(relPath string, err error) {
+	fmt.Println("Failed to upload", relPath+".", err)
+	resultMutex.Lock()
+	resultErr = err
+	resultMutex.Unlock()
+}
+
+// hashFile returns the sha256 of a file on disk.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// saveChunked uploads a large file part by part. Parts that were
+// confirmed aren't sent again when a later part fails, and are removed if
+// it fails for good.
+func saveChunked(path, relPath, sourceId string, size int64) {
+	defer saveWg.Done()
+
+	codec, err := ChooseCodec(path)
+	if err != nil {
+		failUpload(relPath, err)
+		return
+	}
+
+	parts := []Part{}
+	for offset := int64(0); offset < size; offset += partSize {
+		var part Part
+		n, offset := len(parts), offset
+		if err := backoff.Retry(func() error {
+			part, err = savePart(path, sourceId+":"+relPath+":part-"+strconv.Itoa(n), codec, offset)
+			return err
+		}, backoff.NewExponentialBackOff()); err != nil {
+			removeParts(parts)
+			failUpload(relPath, err)
+			return
+		}
+		parts = append(parts, part)
+	}
+
+	digest, err := hashFile(path)
+	if err != nil {
+		removeParts(parts)
+		failUpload(relPath, err)
+		return
+	}
+
+	resultMutex.Lock()
+	for _, part := range parts {
+		resultFileIds = append(resultFileIds, part.Id)
+	}
+	resultOutputs = append(resultOutputs, Output{
+		Path:   relPath,
+		Digest: digest,
+		Codec:  codec,
+		Size:   size,
+		Parts:  parts,
+	})
+	resultMutex.Unlock()
+}
+
+// removeParts removes the parts uploaded before a later one failed.
+func removeParts(parts []Part) {
+	ids := make([]primitive.ObjectID, len(parts))
+	for i, part := range parts {
+		ids[i] = part.Id
+	}
+	removeBlobs(ids)
+}
+
+// savePart uploads a single part of a file starting at offset.
+func savePart(path, name, codec string, offset int64) (Part, error) {
+	content, err := os.Open(path)
+	if err != nil {
+		return Part{}, err
+	}
+	defer content.Close()
+	if _, err = content.Seek(offset, os.SEEK_SET); err != nil {
+		return Part{}, err
+	}
+
+	file, err := store.Create(name, bson.M{"codec": codec, "offset": offset})
+	if err != nil {
+		return Part{}, err
+	}
+
+	encoder, err := Compress(file, codec)
+	if err != nil {
+		return Part{}, abortFile(file, err)
+	}
+	size, err := io.Copy(encoder, io.LimitReader(content, partSize))
+	if err != nil {
+		return Part{}, abortFile(file, err)
+	}
+	if err = encoder.Close(); err != nil {
+		return Part{}, abortFile(file, err)
+	}
+	if err = file.Close(); err != nil {
+		return Part{}, err
+	}
+
+	return Part{Id: file.Id(), Offset: offset, Size: size}, nil
+}
+
+// writeChunked downloads a large output part by part, retrying from the
+// start of the part that failed. The existing file is only replaced once
+// every part is written and the digest matches.
+func (r *Restorer) writeChunked(out Output) {
+	temp, err := createTemp(out.Path)
+	if err != nil {
+		r.fail(err)
+		return
+	}
+
+	for _, part := range out.Parts {
+		part := part
+		if err := backoff.Retry(func() error {
+			return writePart(temp, part, out.Codec)
+		}, backoff.NewExponentialBackOff()); err != nil {
+			discardTemp(temp)
+			r.fail("Failed to download", out.Path+".", err)
+			return
+		}
+	}
+
+	sum, err := hashFile(temp.Name())
+	if err == nil {
+		err = r.verify(out.Path, sum, out)
+	}
+	if err != nil {
+		discardTemp(temp)
+		r.fail(err)
+		return
+	}
+	if err = replaceFile(temp, out.Path); err != nil {
+		r.fail(err)
+		return
+	}
+	r.record(out.Size)
+
+	if err = exec.Command("chmod", "+x", rootPath(out.Path)).Run(); err != nil {
+		r.fail("Failed to make resulting file executable. Please make sure this program has appropriate permission.\n" + err.Error())
+		return
+	}
+	progressBar.Increment()
+}
+
+// writePart writes a part at its offset, discarding anything written
+// past the offset by an earlier attempt.
+func writePart(outfile *os.File, part Part, codec string) error {
+	if err := outfile.Truncate(part.Offset); err != nil {
+		return err
+	}
+	if _, err := outfile.Seek(part.Offset, os.SEEK_SET); err != nil {
+		return err
+	}
+
+	file, err := store.Open(part.Id)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder, err := Decompress(file, codec)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+
+	n, err := io.Copy(outfile, decoder)
+	if err != nil {
+		return err
+	}
+	if n != part.Size {
+		return errors.New("part " + part.Id.Hex() + " is incomplete")
+	}
+
+	return nil
+}
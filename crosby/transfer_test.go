@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/thebyrd/pb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// flakyStore fails the first read of a blob part way through.
+type flakyStore struct {
+	*memoryStore
+	failed map[primitive.ObjectID]bool
+}
+
+func (fs *flakyStore) Open(id primitive.ObjectID) (io.ReadCloser, error) {
+	file, err := fs.memoryStore.Open(id)
+	if err != nil || fs.failed[id] {
+		return file, err
+	}
+
+	fs.failed[id] = true
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(file, 2),
+		&errorReader{errors.New("connection reset")})), nil
+}
+
+type errorReader struct{ err error }
+
+func (er *errorReader) Read(b []byte) (int, error) { return 0, er.err }
+
+func TestChunkedRoundTrip(t *testing.T) {
+	memory, dir, done := useMemoryStore(t)
+	defer done()
+	oldPartSize := partSize
+	partSize = 4
+	defer func() { partSize = oldPartSize }()
+
+	content := []byte("0123456789")
+	path := filepath.Join(dir, "big.bin")
+	if err := ioutil.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saveWg.Add(1)
+	saveChunked(path, "big.bin", primitive.NewObjectID().Hex(), int64(len(content)))
+	if resultErr != nil || len(resultOutputs) != 1 {
+		t.Fatal("expected a single output, got", resultOutputs, resultErr)
+	}
+	out := resultOutputs[0]
+	if len(out.Parts) != 3 || len(memory.blobs) != 3 {
+		t.Fatal("expected 3 parts, got", out.Parts)
+	}
+	for i, part := range out.Parts {
+		if part.Offset != int64(i)*partSize {
+			t.Error("expected part", i, "at offset", int64(i)*partSize, "got", part.Offset)
+		}
+	}
+
+	// Every part fails once after writing some of it.
+	store = &flakyStore{memory, map[primitive.ObjectID]bool{}}
+	restoreDir(t, dir, "restored")
+	progressBar = pb.New(1)
+	r := &Restorer{}
+	r.writeChunked(out)
+	data, _ := ioutil.ReadFile("big.bin")
+	if err := r.Err(); err != nil || !bytes.Equal(data, content) {
+		t.Error("expected the parts to be reassembled, got", string(data), err)
+	}
+
+	// A corrupt part fails the digest.
+	store = memory
+	memory.blobs[out.Parts[1].Id] = memory.blobs[out.Parts[0].Id]
+	restoreDir(t, dir, "corrupt")
+	r = &Restorer{}
+	r.writeChunked(out)
+	if r.Err() == nil {
+		t.Error("expected a corrupt part to fail the restore")
+	}
+	if _, err := ioutil.ReadFile("big.bin"); err == nil {
+		t.Error("expected the corrupt file to be removed")
+	}
+}
+
+// failingStore fails to create blobs with a name containing fail.
+type failingStore struct {
+	*memoryStore
+	fail string
+}
+
+func (fs *failingStore) Create(name string, meta bson.M) (Blob, error) {
+	if strings.Contains(name, fs.fail) {
+		return nil, errors.New("connection reset")
+	}
+	return fs.memoryStore.Create(name, meta)
+}
+
+func TestFailedUploadCleanup(t *testing.T) {
+	memory, dir, done := useMemoryStore(t)
+	defer done()
+	oldPartSize, oldPack, oldChunk, oldMode := partSize, packThreshold, chunkThreshold, mode
+	partSize, packThreshold, chunkThreshold, mode = 4, 8, 8, ModeReadWrite
+	defer func() {
+		partSize, packThreshold, chunkThreshold, mode = oldPartSize, oldPack, oldChunk, oldMode
+	}()
+
+	ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("small"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "big.bin"), []byte("0123456789"), 0644)
+	store = &failingStore{memory, "part-2"}
+
+	err := UploadResult(&Source{Id: primitive.NewObjectID()}, dir, []string{"a.txt", "big.bin"})
+	if err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if len(memory.blobs) != 0 {
+		t.Error("expected the uploaded parts and pack to be removed, got", len(memory.blobs), "blobs")
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the expiry of entries and their invalidation.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const invalidateUsage = `Usage: crosby invalidate [--command <command>] [--project <name>] [--key <prefix>]
+                        [--namespace <namespace>] [--dry-run]`
+
+// ttl is the TTL set by --ttl, overriding the config.
+var ttl time.Duration
+
+// TTLRule sets the TTL of commands matching a pattern.
+type TTLRule struct {
+	// Command is a regexp matched against the command and its arguments,
+	// e.g. "^npm install".
+	Command string `json:"command"`
+
+	// TTL is how long entries can be used, e.g. "24h".
+	TTL string `json:"ttl"`
+}
+
+// CommandTTL returns the TTL for a command from --ttl or the config, zero
+// if entries don't expire.
+func CommandTTL(command string) (time.Duration, error) {
+	if ttl > 0 {
+		return ttl, nil
+	}
+
+	for _, rule := range config.TTL {
+		pattern, err := regexp.Compile(rule.Command)
+		if err != nil {
+			return 0, errors.New("Invalid TTL command " + rule.Command + ": " + err.Error())
+		}
+		if !pattern.MatchString(command) {
+			continue
+		}
+
+		d, err := time.ParseDuration(rule.TTL)
+		if err != nil {
+			return 0, errors.New("Invalid TTL for " + rule.Command + ": " + err.Error())
+		}
+		return d, nil
+	}
+
+	return 0, nil
+}
+
+// ProjectName returns the project entries are stored under.
+func ProjectName() string {
+	if config.Project != "" {
+		return config.Project
+	}
+
+	return filepath.Base(root)
+}
+
+// Expires returns when an entry expires, zero if it doesn't.
+func (s *Source) Expires() time.Time {
+	if s.TTL <= 0 {
+		return time.Time{}
+	}
+
+	created := s.Created
+	if created.IsZero() {
+		created = s.Id.Timestamp()
+	}
+	return created.Add(s.TTL)
+}
+
+// Expired checks if an entry's TTL has passed, expired entries are misses.
+func (s *Source) Expired(now time.Time) bool {
+	expires := s.Expires()
+	return !expires.IsZero() && now.After(expires)
+}
+
+// ExpiresFor returns when an entry expires for a lookup with the TTL
+// current, the shorter of it and the entry's own TTL is used so
+// shortening a TTL applies to entries already cached.
+func (s *Source) ExpiresFor(current time.Duration) time.Time {
+	entry := *s
+	if current > 0 && (entry.TTL <= 0 || current < entry.TTL) {
+		entry.TTL = current
+	}
+	return entry.Expires()
+}
+
+// ExpiredFor checks if an entry has expired for a lookup with the TTL
+// current.
+func (s *Source) ExpiredFor(now time.Time, current time.Duration) bool {
+	expires := s.ExpiresFor(current)
+	return !expires.IsZero() && now.After(expires)
+}
+
+// InvalidateQuery returns the query matching entries in a namespace for a
+// command, a project or a key prefix. Empty filters are ignored.
+func InvalidateQuery(namespace, command, project, key string) bson.M {
+	query := bson.M{"namespace": namespace}
+	if command != "" {
+		query["args"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(command)}
+	}
+	if project != "" {
+		query["project"] = project
+	}
+	if key != "" {
+		query["key"] = primitive.Regex{Pattern: "^" + regexp.QuoteMeta(key)}
+	}
+
+	return query
+}
+
+// InvalidateCommand evicts every entry in the namespace matching the
+// filters, on all platforms.
+func InvalidateCommand(args []string) error {
+	var namespace, command, project, key string
+	var dryRun bool
+	flags := flag.NewFlagSet("invalidate", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&command, "command", "", "")
+	flags.StringVar(&project, "project", "", "")
+	flags.StringVar(&key, "key", "", "")
+	flags.StringVar(&namespace, "namespace", "", "")
+	flags.BoolVar(&dryRun, "dry-run", false, "")
+	if err := flags.Parse(args); err != nil {
+		return errors.New(err.Error() + "\n" + invalidateUsage)
+	}
+	if command == "" && project == "" && key == "" {
+		return errors.New("Must give a command, project or key to invalidate.\n" + invalidateUsage)
+	}
+
+	if !dryRun && !CanWrite(mode) {
+		return ErrReadOnly
+	}
+	if err := OpenStore(); err != nil {
+		return err
+	}
+	mb, err := requireMongo("invalidate")
+	if err != nil {
+		return err
+	}
+	if namespace == "" {
+		namespace = Namespace()
+	}
+
+	entries, err := mb.FindAll(InvalidateQuery(namespace, command, project, key),
+		options.Find().SetProjection(bson.M{"files": 0}))
+	if err != nil {
+		return err
+	}
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	for i := range entries {
+		if !dryRun {
+			if err := RemoveEntry(&entries[i]); err != nil {
+				return err
+			}
+		}
+		fmt.Println(verb, entries[i].Id.Hex(), entries[i].Command)
+	}
+
+	fmt.Printf("%s %d entries.\n", verb, len(entries))
+	return nil
+}
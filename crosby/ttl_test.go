@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCommandTTL(t *testing.T) {
+	old := config
+	config = &Config{TTL: []*TTLRule{
+		{Command: "^npm install", TTL: "24h"},
+		{Command: "^npm", TTL: "1h"},
+	}}
+	defer func() { config = old }()
+
+	cases := map[string]time.Duration{
+		"npm install":        24 * time.Hour,
+		"npm install --save": 24 * time.Hour,
+		"npm test":           time.Hour,
+		"make":               0,
+	}
+	for command, expected := range cases {
+		d, err := CommandTTL(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d != expected {
+			t.Error(command, "expected TTL", expected, "got", d)
+		}
+	}
+}
+
+func TestSourceExpired(t *testing.T) {
+	now := time.Now()
+	s := &Source{Id: primitive.NewObjectIDFromTimestamp(now.Add(-2 * time.Hour))}
+	if s.Expired(now) {
+		t.Error("entry without a TTL expired")
+	}
+
+	s.TTL = time.Hour
+	if !s.Expired(now) {
+		t.Error("expected entry to expire an hour after it was created")
+	}
+
+	s.Created = now.Add(-time.Minute)
+	if s.Expired(now) {
+		t.Error("expected entry created a minute ago to be fresh")
+	}
+}
+
+func TestSourceExpiredFor(t *testing.T) {
+	now := time.Now()
+	s := &Source{Created: now.Add(-2 * time.Hour), TTL: 24 * time.Hour}
+	if s.ExpiredFor(now, 0) || s.ExpiredFor(now, 48*time.Hour) {
+		t.Error("expected the entry's own TTL to apply")
+	}
+	if !s.ExpiredFor(now, time.Hour) {
+		t.Error("expected a shorter TTL on the lookup to expire the entry")
+	}
+
+	s.TTL = 0
+	if !s.ExpiredFor(now, time.Hour) {
+		t.Error("expected a TTL on the lookup to expire an entry without one")
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2014 Bowery, Inc.
+// Contains the usage tracking of cache entries.
+package main
+
+import (
+	"time"
+)
+
+// TimeSaved returns how much a hit saved, the run time less the time it
+// took to restore.
+func TimeSaved(s *Source, restore time.Duration) time.Duration {
+	if s.RunDuration <= restore {
+		return 0
+	}
+
+	return s.RunDuration - restore
+}
+
+// RecordHit updates the usage of an entry after it's restored.
+func RecordHit(s *Source, restore time.Duration) error {
+	saved := TimeSaved(s, restore)
+	s.LastHit = time.Now()
+	s.Hits++
+	s.TimeSaved += saved
+
+	return index.RecordHit(s, saved)
+}
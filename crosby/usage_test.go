@@ -0,0 +1,18 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeSaved(t *testing.T) {
+	s := &Source{RunDuration: time.Minute}
+	if saved := TimeSaved(s, 5*time.Second); saved != 55*time.Second {
+		t.Error("expected 55s saved, got", saved)
+	}
+
+	// A restore slower than the run saves nothing.
+	if saved := TimeSaved(s, 2*time.Minute); saved != 0 {
+		t.Error("expected nothing saved, got", saved)
+	}
+}
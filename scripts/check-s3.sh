@@ -0,0 +1,16 @@
+#!/bin/bash
+#
+# Starts a local S3 compatible server (minio) for the s3 backend if it
+# isn't up. Point s3.endpoint at http://localhost:9000 and create the
+# bucket with `mc mb local/crosby`.
+#
+echo "--> Checking that Minio is Up"
+ps -A | grep [m]inio
+RESULT=$?
+if [ $RESULT -ne 0 ]; then
+    echo "--> Starting Minio..."
+    mkdir -p /tmp/crosby-s3
+    MINIO_ROOT_USER=${AWS_ACCESS_KEY_ID:-crosby} \
+    MINIO_ROOT_PASSWORD=${AWS_SECRET_ACCESS_KEY:-crosbysecret} \
+    minio server /tmp/crosby-s3 &
+fi